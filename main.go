@@ -1,207 +1,2452 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"git.dmoruzzi.com/github-pr-files/pkg/logger"
+	"git.dmoruzzi.com/github-pr-files/pkg/prfiles"
 )
 
 const (
-	githubAPIURL     = "https://api.github.com"
-	acceptHeader     = "application/vnd.github+json"
-	userAgentHeader  = "dmoruzzi/github-pr-info@0.0.0"
-	apiVersionHeader = "2022-11-28"
-	maxChangedFiles  = 3000
-	perPage          = 100
+	maxChangedFiles     = prfiles.MaxListedFiles
+	defaultNameTemplate = "{{.PR}}_{{.Bucket}}.txt"
 )
 
-func githubHeaders(token string) map[string]string {
-	return map[string]string{
-		"Accept":               acceptHeader,
-		"Authorization":        "Bearer " + token,
-		"User-Agent":           userAgentHeader,
-		"X-GitHub-Api-Version": apiVersionHeader,
+type options struct {
+	outputDir     string
+	format        string
+	counts        bool
+	stdout        bool
+	nameTmpl      *template.Template
+	maxFiles      int
+	dryRun        bool
+	alwaysWrite   bool
+	ghOutput      string
+	includes      []string
+	excludes      []string
+	filterRegex   *regexp.Regexp
+	withPatch     bool
+	maxPatchBytes int
+	since         time.Time
+	cacheDir      string
+	multiRepo     bool
+	skipDrafts    bool
+	perPRDir      bool
+	repoDirs      bool
+	onlyAggregate bool
+	prDiff        string
+	skipCount     bool
+	collapseDirs  int
+	markBinary    bool
+	manifest      *manifest
+	blame         *blameCache
+	shaSuffix     bool
+	renameAsDel   bool
+	perCommit     bool
+	graphql       bool
+	sink          fileSink
+	escapeNames   bool
+	print0        bool
+
+	stripPrefix    string
+	keepUnprefixed bool
+	checksum       bool
+	generated      *generatedCache
+	withURLs       bool
+	mergeQueue     bool
+	requireLabels  []string
+	skipLabels     []string
+	labelFold      bool
+	prTimeout      time.Duration
+}
+
+type nameFields struct {
+	PR     string
+	Bucket string
+}
+
+type prResult struct {
+	repo    string
+	pr      int
+	skipped bool
+	files   map[string][]string
+	entries []prfiles.FileChange
+
+	base, head string
+	truncated  int
+	incomplete bool
+}
+
+// prSummary holds the number of files in each bucket of a pull request.
+type prSummary struct {
+	Repo    string `json:"repo,omitempty"`
+	PR      int    `json:"pr"`
+	Base    string `json:"base,omitempty"`
+	Head    string `json:"head,omitempty"`
+	Changed int    `json:"changed"`
+	Deleted int    `json:"deleted"`
+	Total   int    `json:"total"`
+
+	TruncatedPatches int  `json:"truncated_patches,omitempty"`
+	Incomplete       bool `json:"incomplete,omitempty"`
+}
+
+// runSummary is the -summary report: per pull request counts plus their sum.
+type runSummary struct {
+	PullRequests []prSummary `json:"pull_requests"`
+	Changed      int         `json:"changed"`
+	Deleted      int         `json:"deleted"`
+	Total        int         `json:"total"`
+
+	TruncatedPatches int `json:"truncated_patches,omitempty"`
+}
+
+func (s *runSummary) add(repo string, result *prResult) {
+	files := result.files
+	summary := prSummary{Repo: repo, PR: result.pr, Base: result.base, Head: result.head, Changed: len(files["chg"]), Deleted: len(files["del"]), Total: len(files["all"]), TruncatedPatches: result.truncated, Incomplete: result.incomplete}
+	s.PullRequests = append(s.PullRequests, summary)
+	s.Changed += summary.Changed
+	s.Deleted += summary.Deleted
+	s.Total += summary.Total
+	s.TruncatedPatches += summary.TruncatedPatches
+}
+
+// blameCache remembers LastCommitAuthor results per repository and path, so
+// files changed by several pull requests are looked up once per run.
+type blameCache struct {
+	mu      sync.Mutex
+	authors map[string]string
+}
+
+// generatedCache remembers the linguist-generated patterns of each
+// repository and commit, so pull requests sharing a head commit read
+// .gitattributes once per run.
+type generatedCache struct {
+	mu       sync.Mutex
+	patterns map[string][]generatedPattern
+}
+
+// generatedPatterns returns the linguist-generated patterns in the root
+// .gitattributes of repo at sha. A missing .gitattributes has none.
+func generatedPatterns(ctx context.Context, client *prfiles.Client, opts *options, repo string, sha string) ([]generatedPattern, error) {
+	key := repo + "\x00" + sha
+	opts.generated.mu.Lock()
+	patterns, ok := opts.generated.patterns[key]
+	opts.generated.mu.Unlock()
+	if ok {
+		return patterns, nil
+	}
+
+	content, err := prfiles.FileContent(ctx, client, repo, ".gitattributes", sha)
+	switch {
+	case errors.Is(err, prfiles.ErrNotFound):
+		logger.Debugf("No .gitattributes in %s at %s", repo, sha)
+	case err != nil:
+		return nil, err
+	default:
+		patterns = parseGeneratedPatterns(string(content))
+	}
+	opts.generated.mu.Lock()
+	opts.generated.patterns[key] = patterns
+	opts.generated.mu.Unlock()
+	return patterns, nil
+}
+
+// addAuthors sets LastAuthor on each entry, looking up paths not seen
+// before. Lookup failures are logged and leave LastAuthor empty.
+func addAuthors(ctx context.Context, client *prfiles.Client, opts *options, repo string, entries []prfiles.FileChange) {
+	for i := range entries {
+		key := repo + "\x00" + entries[i].Filename
+		opts.blame.mu.Lock()
+		author, ok := opts.blame.authors[key]
+		opts.blame.mu.Unlock()
+		if !ok {
+			var err error
+			author, err = prfiles.LastCommitAuthor(ctx, client, repo, entries[i].Filename)
+			if err != nil {
+				logger.Warnf("Failed to find the last author of %s: %v", entries[i].Filename, err)
+				continue
+			}
+			opts.blame.mu.Lock()
+			opts.blame.authors[key] = author
+			opts.blame.mu.Unlock()
+		}
+		entries[i].LastAuthor = author
+	}
+}
+
+// manifestFile describes one output file in the -manifest. PR is 0 for
+// aggregate files and comparisons, and Lines counts file records rather than
+// lines for JSON and CSV outputs.
+type manifestFile struct {
+	Path   string `json:"path"`
+	Repo   string `json:"repo,omitempty"`
+	PR     int    `json:"pr,omitempty"`
+	Bucket string `json:"bucket"`
+	Lines  int    `json:"lines"`
+}
+
+// manifest collects the files written by concurrent pull requests.
+type manifest struct {
+	mu    sync.Mutex
+	files []manifestFile
+}
+
+// recordOutput adds a written file to the -manifest, if one was requested.
+// Nothing is recorded in a dry run, since nothing is written.
+func recordOutput(opts *options, repo string, pr int, bucket string, filePath string, lines int) {
+	if opts.manifest == nil || opts.dryRun {
+		return
+	}
+	if !opts.multiRepo {
+		repo = ""
+	}
+	opts.manifest.mu.Lock()
+	defer opts.manifest.mu.Unlock()
+	opts.manifest.files = append(opts.manifest.files, manifestFile{filePath, repo, pr, bucket, lines})
+}
+
+// writeManifest writes the recorded files, sorted by path, to filePath.
+func writeManifest(opts *options, filePath string) {
+	if opts.manifest == nil {
+		return
+	}
+	files := opts.manifest.files
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	doc := struct {
+		Files []manifestFile `json:"files"`
+	}{files}
+	if doc.Files == nil {
+		doc.Files = []manifestFile{}
+	}
+	if err := writeOutputJSON(opts, filePath, doc); err != nil {
+		logger.Fatalf("Failed to write manifest: %v", err)
+	}
+}
+
+// extensionStats holds the number of files with one extension in each
+// bucket. Renamed files count as changed, as in the aggregate files.
+type extensionStats struct {
+	Extension string `json:"extension"`
+	Changed   int    `json:"changed"`
+	Deleted   int    `json:"deleted"`
+	Total     int    `json:"total"`
+}
+
+// addExtensionStats tallies the files in merged by extension into stats.
+// Files without an extension are counted under "(none)".
+func addExtensionStats(stats []extensionStats, merged map[string]prfiles.FileChange) []extensionStats {
+	for name, entry := range merged {
+		ext := path.Ext(name)
+		if ext == "" {
+			ext = "(none)"
+		}
+		i := slices.IndexFunc(stats, func(s extensionStats) bool { return s.Extension == ext })
+		if i < 0 {
+			stats = append(stats, extensionStats{Extension: ext})
+			i = len(stats) - 1
+		}
+		if entry.Status == prfiles.CategoryDeleted {
+			stats[i].Deleted++
+		} else {
+			stats[i].Changed++
+		}
+		stats[i].Total++
+	}
+	return stats
+}
+
+// writeStats writes stats, most common extension first, as JSON if filePath
+// ends in .json and as "ext: counts" lines otherwise. A filePath of "-"
+// prints the lines.
+func writeStats(opts *options, filePath string, stats []extensionStats) error {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total != stats[j].Total {
+			return stats[i].Total > stats[j].Total
+		}
+		return stats[i].Extension < stats[j].Extension
+	})
+	if strings.HasSuffix(filePath, ".json") {
+		return writeOutputJSON(opts, filePath, stats)
+	}
+
+	var lines []string
+	for _, s := range stats {
+		lines = append(lines, s.Extension+": "+summaryLine(s.Changed, s.Deleted, s.Total, 0))
+	}
+	if filePath == "-" {
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+	return writeOutputLines(opts, filePath, lines, "\n")
+}
+
+// summaryLine formats the counts of one summary row.
+func summaryLine(changed, deleted, total, truncated int) string {
+	line := fmt.Sprintf("%d changed, %d deleted, %d total", changed, deleted, total)
+	if truncated > 0 {
+		line += fmt.Sprintf(", %d patch(es) truncated", truncated)
+	}
+	return line
+}
+
+// writeSummary writes the summary as JSON if filePath ends in .json and as
+// one line per pull request otherwise. A filePath of "-" prints the text
+// report to standard output.
+func writeSummary(opts *options, filePath string, summary *runSummary) error {
+	sort.Slice(summary.PullRequests, func(i, j int) bool {
+		a, b := summary.PullRequests[i], summary.PullRequests[j]
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.PR < b.PR
+	})
+	if strings.HasSuffix(filePath, ".json") {
+		return writeOutputJSON(opts, filePath, summary)
+	}
+
+	var lines []string
+	for _, pr := range summary.PullRequests {
+		line := prLabel(pr.Repo, pr.PR)
+		if pr.Base != "" {
+			line += fmt.Sprintf(" (%s -> %s)", pr.Head, pr.Base)
+		}
+		line += ": " + summaryLine(pr.Changed, pr.Deleted, pr.Total, pr.TruncatedPatches)
+		if pr.Incomplete {
+			line += " (incomplete)"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "All: "+summaryLine(summary.Changed, summary.Deleted, summary.Total, summary.TruncatedPatches))
+	if filePath == "-" {
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+	return writeOutputLines(opts, filePath, lines, "\n")
+}
+
+// prLabel names a pull request in logs and reports, qualifying it with its
+// repository when one is given.
+func prLabel(repo string, pr int) string {
+	if repo == "" {
+		return fmt.Sprintf("PR %d", pr)
+	}
+	return fmt.Sprintf("%s#%d", repo, pr)
+}
+
+// fileID prefixes id with the sanitized repository when processing multiple
+// repositories into one directory, so output files from different
+// repositories do not collide.
+func fileID(opts *options, repo string, id string) string {
+	if !opts.multiRepo || opts.repoDirs {
+		return id
+	}
+	return strings.ReplaceAll(repo, "/", "_") + "_" + id
+}
+
+// prJob is a single pull request to process.
+type prJob struct {
+	repo string
+	pr   int
+}
+
+// repoOptions returns the options for writing repo's output. With
+// -output-dir-per-repo, the output directory becomes {output-dir}/{owner}/{name},
+// which is created unless nothing is written to disk.
+func repoOptions(opts *options, repo string) (*options, error) {
+	if !opts.repoDirs {
+		return opts, nil
+	}
+	owner, name, err := parseRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range []string{owner, name} {
+		if part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+			return nil, fmt.Errorf("repository %q cannot be used as an output path", repo)
+		}
+	}
+
+	repoOpts := *opts
+	repoOpts.outputDir = filepath.Join(opts.outputDir, owner, name)
+	if !opts.stdout && opts.ghOutput == "" && !opts.dryRun {
+		if err := repoOpts.sink.MkdirAll(repoOpts.outputDir); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	return &repoOpts, nil
+}
+
+// conflictingFlags lists, for each flag, the flags it cannot be combined
+// with. Conflicts that depend on a flag's value are in flagRules.
+var conflictingFlags = []struct {
+	name     string
+	excludes []string
+}{
+	{"token", []string{"token-file", "token-env", "tokens"}},
+	{"token-file", []string{"token-env", "tokens"}},
+	{"token-env", []string{"tokens"}},
+	{"tokens", []string{"app-id"}},
+	{"pulls", []string{"pulls-file", "state", "query"}},
+	{"pulls-file", []string{"state", "query"}},
+	{"state", []string{"query"}},
+	{"compare", []string{"pulls", "pulls-file", "state", "query", "commit", "diff-prs", "summary", "stats"}},
+	{"commit", []string{"pulls", "pulls-file", "state", "query", "diff-prs", "summary", "stats"}},
+	{"diff-prs", []string{"pulls", "pulls-file", "state", "query"}},
+	{"stdout", []string{"output-dir", "github-output", "append", "manifest", "always-write"}},
+	{"no-aggregate", []string{"only-aggregate", "append"}},
+	{"per-pr-dir", []string{"name-template"}},
+	{"checksum", []string{"stdout", "github-output"}},
+	{"exclude-generated", []string{"compare", "commit", "diff-prs"}},
+	{"merge-queue", []string{"pr-diff", "compare", "commit", "diff-prs"}},
+	{"require-label", []string{"compare", "commit", "diff-prs"}},
+	{"skip-label", []string{"compare", "commit", "diff-prs"}},
+	{"strip-prefix", []string{"with-blame"}},
+	{"graphql", []string{"with-patch", "pr-diff", "rename-as-delete-add", "with-urls"}},
+	{"skip-count", []string{"max-files"}},
+	{"per-commit", []string{"stdout", "github-output", "only-aggregate", "compare", "commit", "diff-prs"}},
+}
+
+// flagSet holds the flags given on the command line by name, with their
+// values. Flags set to false or to an empty string are left out.
+type flagSet map[string]string
+
+func (f flagSet) has(name string) bool {
+	_, ok := f[name]
+	return ok
+}
+
+// format returns the -format value, defaulting to text.
+func (f flagSet) format() string {
+	if format, ok := f["format"]; ok {
+		return format
+	}
+	return "text"
+}
+
+// dataOnStdout reports whether the run writes machine-readable output to
+// stdout, which printed summaries or stats would corrupt.
+func (f flagSet) dataOnStdout() bool {
+	return f.format() == "ndjson" || (f.has("stdout") && (f.format() == "json" || f.format() == "csv"))
+}
+
+// flagRules lists combinations of flags that depend on their values, or on
+// another flag being given, with the error reported for each.
+var flagRules = []struct {
+	violated func(f flagSet) bool
+	message  string
+}{
+	{func(f flagSet) bool {
+		return (f.has("app-id") || f.has("app-private-key") || f.has("installation-id")) &&
+			!(f.has("app-id") && f.has("app-private-key") && f.has("installation-id"))
+	}, "-app-id, -app-private-key, and -installation-id must be used together"},
+	{func(f flagSet) bool {
+		return f.format() == "ndjson" && (f.has("compare") || f.has("commit") || f.has("diff-prs"))
+	}, "-format ndjson cannot be used with -compare, -commit, or -diff-prs"},
+	// NDJSON is always streamed to stdout, so it shares -stdout's conflicts.
+	{func(f flagSet) bool {
+		return f.format() == "ndjson" && (f.has("output-dir") || f.has("github-output") || f.has("append") || f.has("manifest") || f.has("always-write"))
+	}, "-format ndjson is written to stdout and cannot be used with -output-dir, -github-output, -append, -manifest, or -always-write"},
+	{func(f flagSet) bool {
+		return f.dataOnStdout() && (f["summary"] == "-" || f["stats"] == "-")
+	}, "-summary - and -stats - print to stdout and cannot be used with -format ndjson or with -stdout in json or csv format"},
+	{func(f flagSet) bool { return f.format() == "ndjson" && f.has("checksum") }, "-format ndjson cannot be used with -checksum"},
+	{func(f flagSet) bool { return f.has("compare") && f.format() == "csv" }, "-compare does not support -format csv"},
+	{func(f flagSet) bool { return f.has("commit") && f.format() == "csv" }, "-commit does not support -format csv"},
+	{func(f flagSet) bool {
+		return f.has("with-urls") && f.format() != "json" && f.format() != "ndjson"
+	}, "-with-urls requires -format json or ndjson"},
+	{func(f flagSet) bool { return f.has("with-blame") && f.format() == "text" }, "-with-blame requires -format json, csv, or ndjson"},
+	{func(f flagSet) bool {
+		return f.has("label-ignore-case") && !f.has("require-label") && !f.has("skip-label")
+	}, "-label-ignore-case requires -require-label or -skip-label"},
+	{func(f flagSet) bool { return f.has("keep-unprefixed") && !f.has("strip-prefix") }, "-keep-unprefixed requires -strip-prefix"},
+	{func(f flagSet) bool {
+		return f.has("per-commit") && f.format() != "text" && f.format() != "json"
+	}, "-per-commit requires -format text or json"},
+	{func(f flagSet) bool {
+		return f.has("append") && f.format() != "text"
+	}, "-append only applies to the aggregate text files and requires -format text"},
+	{func(f flagSet) bool {
+		return f.has("collapse-dirs") && f["collapse-dirs"] != "0" && (f.format() != "text" || f.has("counts") || f.has("with-status"))
+	}, "-collapse-dirs only applies to the text format and cannot be used with -counts or -with-status"},
+	{func(f flagSet) bool { return f.has("print0") && f.format() != "text" }, "-print0 requires -format text"},
+}
+
+// validateFlags reports the first conflict between the flags given on the
+// command line.
+func validateFlags() error {
+	set := make(flagSet)
+	flag.Visit(func(f *flag.Flag) {
+		if value := f.Value.String(); value != "false" && value != "" {
+			set[f.Name] = value
+		}
+	})
+	return checkFlags(set)
+}
+
+// checkFlags reports the first pair of conflicting flags in set, then the
+// first violated flagRules entry.
+func checkFlags(set flagSet) error {
+	for _, conflict := range conflictingFlags {
+		if !set.has(conflict.name) {
+			continue
+		}
+		for _, other := range conflict.excludes {
+			if set.has(other) {
+				return fmt.Errorf("-%s cannot be used with -%s", conflict.name, other)
+			}
+		}
+	}
+	for _, rule := range flagRules {
+		if rule.violated(set) {
+			return errors.New(rule.message)
+		}
+	}
+	return nil
+}
+
+func redactToken(token string) string {
+	if len(token) <= 8 {
+		return "[REDACTED]"
+	}
+	return token[:4] + "..." + "[REDACTED]"
+}
+
+// maxPRRange bounds the size of a single range, so a typo such as
+// 1-2000000000 fails instead of allocating billions of numbers.
+const maxPRRange = 10000
+
+// expandPRRanges expands a comma-separated list of pull request numbers and
+// inclusive ranges. Overlapping ranges are not merged; parsePRList drops the
+// repeated numbers.
+func expandPRRanges(s string) ([]int, error) {
+	var prs []int
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		startText, endText, isRange := strings.Cut(p, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(startText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pull request number: %s", p)
+		}
+		if start <= 0 {
+			return nil, fmt.Errorf("invalid pull request number: %s (must be positive)", p)
+		}
+		if !isRange {
+			prs = append(prs, start)
+			continue
+		}
+
+		end, err := strconv.Atoi(strings.TrimSpace(endText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pull request range: %s", p)
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid pull request range: %s (start is greater than end)", p)
+		}
+		if end-start >= maxPRRange {
+			return nil, fmt.Errorf("invalid pull request range: %s (more than %d pull requests)", p, maxPRRange)
+		}
+		for pr := start; pr <= end; pr++ {
+			prs = append(prs, pr)
+		}
+	}
+	return prs, nil
+}
+
+func parseRepo(repo string) (string, string, error) {
+	owner, name, found := strings.Cut(repo, "/")
+	if !found || owner == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("invalid repository %q: expected the format 'owner/name'", repo)
+	}
+	return owner, name, nil
+}
+
+// repoFromGit returns the owner/name of the origin remote of the git
+// repository in the working directory.
+func repoFromGit() (string, error) {
+	out, err := exec.Command("git", "remote", "get-url", "origin").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git remote get-url origin: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git remote get-url origin: %w", err)
+	}
+	return parseRemoteURL(strings.TrimSpace(string(out)))
+}
+
+// parseRemoteURL extracts owner/name from a git remote URL in the HTTPS
+// (https://github.com/owner/name.git), SSH (ssh://git@github.com/owner/name)
+// or scp-like (git@github.com:owner/name.git) form.
+func parseRemoteURL(remote string) (string, error) {
+	repoPath := remote
+	if _, rest, ok := strings.Cut(remote, "://"); ok {
+		_, repoPath, _ = strings.Cut(rest, "/")
+	} else if _, rest, ok := strings.Cut(remote, ":"); ok {
+		repoPath = rest
+	}
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	parts := strings.Split(repoPath, "/")
+	if len(parts) < 2 || parts[len(parts)-2] == "" || parts[len(parts)-1] == "" {
+		return "", fmt.Errorf("cannot find owner/name in remote URL %q", remote)
+	}
+	return parts[len(parts)-2] + "/" + parts[len(parts)-1], nil
+}
+
+// parseRepos splits a comma-separated list of repositories, validating each
+// and dropping duplicates.
+func parseRepos(value string) ([]string, error) {
+	var repos []string
+	for _, repo := range strings.Split(value, ",") {
+		repo = strings.TrimSpace(repo)
+		if repo == "" || slices.Contains(repos, repo) {
+			continue
+		}
+		if _, _, err := parseRepo(repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("no repository given")
+	}
+	return repos, nil
+}
+
+func parsePRList(r io.Reader, source string) ([]int, error) {
+	var prs []int
+	seen := make(map[int]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		expanded, err := expandPRRanges(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", source, line, err)
+		}
+		for _, pr := range expanded {
+			if seen[pr] {
+				logger.Debugf("Ignoring repeated pull request %d in %s", pr, source)
+				continue
+			}
+			seen[pr] = true
+			prs = append(prs, pr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	if len(prs) == 0 {
+		return nil, fmt.Errorf("no pull request numbers found in %s", source)
+	}
+	return prs, nil
+}
+
+func statusSeverity(status string) int {
+	switch status {
+	case prfiles.CategoryDeleted:
+		return 2
+	case prfiles.CategoryRenamed:
+		return 1
+	}
+	return 0
+}
+
+// matchGlob reports whether name matches pattern. Patterns without a "/"
+// match the base name; others match the whole path, where a "**" segment
+// matches any number of directories.
+func matchGlob(pattern string, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(name))
+		return matched
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches the segments of a path against those of a pattern.
+// A "**" segment matches zero or more segments, except at the end of the
+// pattern, where it matches at least one, so "dir/**" matches the files
+// below dir but not a file named dir.
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(name) > 0
+		}
+		for i := range len(name) + 1 {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], name[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+func matchFilters(name string, includes []string, excludes []string) bool {
+	for _, pattern := range excludes {
+		if matchGlob(pattern, name) {
+			return false
+		}
+	}
+	if len(includes) == 0 {
+		return true
+	}
+	for _, pattern := range includes {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// deletedMatches returns the deleted files in entries that match any of
+// patterns.
+func deletedMatches(entries []prfiles.FileChange, patterns []string) []string {
+	var matches []string
+	for _, entry := range entries {
+		if entry.Status != prfiles.CategoryDeleted {
+			continue
+		}
+		for _, pattern := range patterns {
+			if matchGlob(pattern, entry.Filename) {
+				matches = append(matches, entry.Filename)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// generatedPattern is a .gitattributes pattern that sets or unsets the
+// linguist-generated attribute. Anchored patterns had a leading "/" and only
+// match from the repository root.
+type generatedPattern struct {
+	pattern   string
+	anchored  bool
+	generated bool
+}
+
+// parseGeneratedPatterns returns the lines of a .gitattributes file that set
+// (linguist-generated, linguist-generated=true) or unset
+// (-linguist-generated, !linguist-generated, linguist-generated=false) the
+// linguist-generated attribute, in file order.
+func parseGeneratedPatterns(text string) []generatedPattern {
+	var patterns []generatedPattern
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		pattern, anchored := strings.CutPrefix(fields[0], "/")
+		for _, attr := range fields[1:] {
+			switch {
+			case attr == "linguist-generated" || attr == "linguist-generated=true":
+				patterns = append(patterns, generatedPattern{pattern, anchored, true})
+			case attr == "-linguist-generated" || attr == "!linguist-generated" || attr == "linguist-generated=false":
+				patterns = append(patterns, generatedPattern{pattern, anchored, false})
+			}
+		}
+	}
+	return patterns
+}
+
+// isGenerated reports whether name is marked linguist-generated. As in git,
+// a leading "/" or one inside the pattern anchors it to the root, and the
+// last matching pattern wins.
+func isGenerated(name string, patterns []generatedPattern) bool {
+	generated := false
+	for _, p := range patterns {
+		matched := matchGlob(p.pattern, name)
+		if p.anchored {
+			matched = matchSegments(strings.Split(p.pattern, "/"), strings.Split(name, "/"))
+		}
+		if matched {
+			generated = p.generated
+		}
+	}
+	return generated
+}
+
+// dropGenerated returns the changes whose files are not marked
+// linguist-generated, without modifying changes.
+func dropGenerated(changes []prfiles.FileChange, patterns []generatedPattern) []prfiles.FileChange {
+	if len(patterns) == 0 {
+		return changes
+	}
+	kept := make([]prfiles.FileChange, 0, len(changes))
+	for _, change := range changes {
+		if isGenerated(change.Filename, patterns) {
+			logger.Debugf("Excluding generated file %s", change.Filename)
+			continue
+		}
+		kept = append(kept, change)
+	}
+	return kept
+}
+
+func parsePatterns(value string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// sanitizeFilename turns a repository path into a single safe file name.
+// Path separators and other unsafe characters become "_", and names that had
+// to be changed get a short hash of the original path so that, for example,
+// "a/b.go" and "a_b.go" do not collide.
+func sanitizeFilename(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_') {
+			return r
+		}
+		return '_'
+	}, name)
+	if safe == name && safe != "." && safe != ".." {
+		return safe
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	ext := path.Ext(safe)
+	return strings.TrimSuffix(safe, ext) + "-" + hex.EncodeToString(sum[:4]) + ext
+}
+
+func hasControlChars(name string) bool {
+	return strings.IndexFunc(name, unicode.IsControl) >= 0
+}
+
+// escapeControlChars replaces newlines, tabs, and other control characters in
+// name with Go-style escapes such as \n, so each file stays on one line.
+func escapeControlChars(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+const truncatedMarker = "\n... [truncated]"
+
+// truncatePatch cuts patch to at most maxBytes bytes, not splitting a UTF-8
+// sequence, and appends a marker. It reports whether the patch was cut; a
+// maxBytes of 0 means no limit.
+func truncatePatch(patch string, maxBytes int) (string, bool) {
+	if maxBytes <= 0 || len(patch) <= maxBytes {
+		return patch, false
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(patch[cut]) {
+		cut--
+	}
+	return patch[:cut] + truncatedMarker, true
+}
+
+func patchFileName(id string, filename string) string {
+	return fmt.Sprintf("%s_%s.patch", id, sanitizeFilename(filename))
+}
+
+func writePatches(opts *options, repo string, pr int, id string, entries []prfiles.FileChange) error {
+	var errs []error
+	for _, entry := range entries {
+		if entry.Patch == "" {
+			logger.Debugf("No patch available for %s in %s (binary or too large)", entry.Filename, id)
+			continue
+		}
+		filePath := filepath.Join(opts.outputDir, patchFileName(id, entry.Filename))
+		if opts.perPRDir {
+			filePath = filepath.Join(opts.outputDir, id, sanitizeFilename(entry.Filename)+".patch")
+		}
+		if err := writeOutputLines(opts, filePath, []string{entry.Patch}, "\n"); err != nil {
+			logger.Errorf("Failed to write file %s: %v", filePath, err)
+			errs = append(errs, err)
+			continue
+		}
+		recordOutput(opts, repo, pr, "patch", filePath, strings.Count(entry.Patch, "\n")+1)
+	}
+	return errors.Join(errs...)
+}
+
+// fileListChecksum returns the hex sha256 of the status and path of each
+// entry, one "status<TAB>filename[<TAB>previous]" line per entry in sorted
+// order, so it only changes when the list of files or their statuses do.
+func fileListChecksum(entries []prfiles.FileChange) string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		line := entry.Status + "\t" + entry.Filename
+		if entry.PreviousFilename != "" {
+			line += "\t" + entry.PreviousFilename
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeChecksum writes the -checksum of entries to filePath.
+func writeChecksum(opts *options, repo string, pr int, filePath string, entries []prfiles.FileChange) error {
+	if err := writeOutputLines(opts, filePath, []string{fileListChecksum(entries)}, "\n"); err != nil {
+		return err
+	}
+	recordOutput(opts, repo, pr, "checksum", filePath, 1)
+	return nil
+}
+
+func formatLine(entry prfiles.FileChange, counts bool) string {
+	if counts {
+		return fmt.Sprintf("%s\t%d\t%d\t%d", entry.Filename, entry.Additions, entry.Deletions, entry.Changes)
+	}
+	return entry.Filename
+}
+
+func mergeStatuses(entries map[int][]prfiles.FileChange) map[string]prfiles.FileChange {
+	merged := make(map[string]prfiles.FileChange)
+	for _, changes := range entries {
+		for _, change := range changes {
+			current, ok := merged[change.Filename]
+			if !ok {
+				merged[change.Filename] = change
+				continue
+			}
+			if statusSeverity(change.Status) > statusSeverity(current.Status) {
+				current.Status = change.Status
+				current.PreviousFilename = change.PreviousFilename
+			}
+			current.Binary = current.Binary || change.Binary
+			current.Additions += change.Additions
+			current.Deletions += change.Deletions
+			current.Changes += change.Changes
+			merged[change.Filename] = current
+		}
+	}
+	return merged
+}
+
+func compactSorted(lines []string) []string {
+	sort.Strings(lines)
+	return slices.Compact(lines)
+}
+
+func statusAggregates(merged map[string]prfiles.FileChange, withStatus bool, counts bool, renameAsDelete bool) map[string][]string {
+	aggregates := map[string][]string{"all": nil, "chg": nil, "del": nil}
+	for _, entry := range merged {
+		line := formatLine(entry, counts)
+		if withStatus {
+			line = entry.Status + "\t" + line
+		}
+		aggregates["all"] = append(aggregates["all"], line)
+		if entry.Binary {
+			aggregates["bin"] = append(aggregates["bin"], line)
+		} else if entry.Status == prfiles.CategoryDeleted {
+			aggregates["del"] = append(aggregates["del"], line)
+		} else {
+			aggregates["chg"] = append(aggregates["chg"], line)
+		}
+		if renameAsDelete && entry.Status == prfiles.CategoryRenamed && entry.PreviousFilename != "" {
+			old := formatLine(prfiles.FileChange{Filename: entry.PreviousFilename}, counts)
+			if withStatus {
+				old = prfiles.CategoryDeleted + "\t" + old
+			}
+			aggregates["del"] = append(aggregates["del"], old)
+		}
+	}
+	return aggregates
+}
+
+func parseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	name, err := executeNameTemplate(tmpl, "123", "chg")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("invalid name template: produces an empty filename")
+	}
+	return tmpl, nil
+}
+
+func executeNameTemplate(tmpl *template.Template, pr string, bucket string) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, nameFields{PR: pr, Bucket: bucket}); err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+	return sb.String(), nil
+}
+
+func outputPath(opts *options, pr string, bucket string) (string, error) {
+	name, err := executeNameTemplate(opts.nameTmpl, pr, bucket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(opts.outputDir, name), nil
+}
+
+// fileSink receives the files a run writes, and the existing files it reads
+// back or appends to. Paths are passed as built from the output directory, so
+// other sinks (in memory, object storage) can map them as they like.
+type fileSink interface {
+	WriteFile(filePath string, data []byte) error
+	// AppendFile appends data to filePath, creating it if needed.
+	AppendFile(filePath string, data []byte) error
+	// ReadFile returns an error matching os.ErrNotExist for missing files.
+	ReadFile(filePath string) ([]byte, error)
+	MkdirAll(dir string) error
+	// CheckWritable reports whether files can be created in dir.
+	CheckWritable(dir string) error
+}
+
+// diskSink writes files to the local filesystem atomically.
+type diskSink struct{}
+
+func (diskSink) WriteFile(filePath string, data []byte) error {
+	return writeFileAtomic(filePath, data)
+}
+
+func (diskSink) AppendFile(filePath string, data []byte) error {
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (diskSink) ReadFile(filePath string) ([]byte, error) {
+	return os.ReadFile(filePath)
+}
+
+func (diskSink) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+// CheckWritable creates and removes a temporary file in dir, so an
+// unwritable output directory fails the run before any API requests.
+func (diskSink) CheckWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".github-pr-files-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// writeFile writes each line followed by terminator.
+func writeFile(sink fileSink, filePath string, lines []string, terminator string) error {
+	var data string
+	if len(lines) > 0 {
+		data = strings.Join(lines, terminator) + terminator
+	}
+	return sink.WriteFile(filePath, []byte(data))
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over filePath, so readers see either the previous contents or
+// the complete new file, never a partial write.
+func writeFileAtomic(filePath string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// printFiles prints a list of files to standard output, NUL-terminated with
+// -print0.
+func printFiles(opts *options, filenames []string) {
+	for _, file := range filenames {
+		if opts.print0 {
+			fmt.Print(file + "\x00")
+		} else {
+			fmt.Println(file)
+		}
+	}
+}
+
+// mergeExisting returns lines merged with the lines already in filePath,
+// sorted and without duplicates. A missing file is treated as empty.
+func mergeExisting(opts *options, filePath string, lines []string) ([]string, error) {
+	data, err := opts.sink.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return compactSorted(lines), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	terminator := "\n"
+	if opts.print0 {
+		terminator = "\x00"
+	}
+	existing := strings.Split(strings.TrimSuffix(string(data), terminator), terminator)
+	if len(data) == 0 {
+		existing = nil
+	}
+	return compactSorted(append(existing, lines...)), nil
+}
+
+// writeOutputFile writes a list of files, NUL-terminated with -print0 and
+// newline-terminated otherwise.
+func writeOutputFile(opts *options, filePath string, filenames []string) error {
+	terminator := "\n"
+	if opts.print0 {
+		terminator = "\x00"
+	}
+	return writeOutputLines(opts, filePath, filenames, terminator)
+}
+
+func writeOutputLines(opts *options, filePath string, lines []string, terminator string) error {
+	if opts.dryRun {
+		logger.Infof("Dry run: would write %d line(s) to %s", len(lines), filePath)
+		return nil
+	}
+	return writeFile(opts.sink, filePath, lines, terminator)
+}
+
+func writeOutputJSON(opts *options, filePath string, v any) error {
+	if opts.dryRun {
+		logger.Infof("Dry run: would write JSON to %s", filePath)
+		return nil
+	}
+	return writeJSON(opts.sink, filePath, v)
+}
+
+// writeCSV writes one row per file of each repository in repos. A leading
+// repo column is added when processing multiple repositories.
+func writeCSV(w io.Writer, opts *options, repos []string, entries map[string]map[int][]prfiles.FileChange) error {
+	header := []string{"pr", "filename", "status", "additions", "deletions"}
+	if opts.blame != nil {
+		header = append(header, "last_author")
+	}
+	if opts.multiRepo {
+		header = append([]string{"repo"}, header...)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		prs := make([]int, 0, len(entries[repo]))
+		for pr := range entries[repo] {
+			prs = append(prs, pr)
+		}
+		sort.Ints(prs)
+
+		for _, pr := range prs {
+			for _, entry := range entries[repo][pr] {
+				record := []string{strconv.Itoa(pr), entry.Filename, entry.Status, strconv.Itoa(entry.Additions), strconv.Itoa(entry.Deletions)}
+				if opts.blame != nil {
+					record = append(record, entry.LastAuthor)
+				}
+				if opts.multiRepo {
+					record = append([]string{repo}, record...)
+				}
+				if err := cw.Write(record); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeOutputCSV(opts *options, filePath string, repos []string, entries map[string]map[int][]prfiles.FileChange) error {
+	if opts.dryRun {
+		logger.Infof("Dry run: would write CSV to %s", filePath)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, opts, repos, entries); err != nil {
+		return err
+	}
+	return opts.sink.WriteFile(filePath, buf.Bytes())
+}
+
+// writeGitHubOutput appends each list as a multiline step output using the
+// name<<DELIMITER syntax. The delimiter is randomized if "EOF" appears as a
+// line in any of the values, so file names can never end the block early.
+func writeGitHubOutput(opts *options, outputs map[string][]string) error {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	delimiter := "EOF"
+	for _, lines := range outputs {
+		if slices.Contains(lines, delimiter) {
+			buf := make([]byte, 16)
+			if _, err := rand.Read(buf); err != nil {
+				return err
+			}
+			delimiter = "ghadelimiter_" + hex.EncodeToString(buf)
+			break
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		lines := outputs[name]
+		sort.Strings(lines)
+		fmt.Fprintf(&b, "%s<<%s\n", name, delimiter)
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+		b.WriteString(delimiter + "\n")
+	}
+
+	if opts.dryRun {
+		logger.Infof("Dry run: would append %d output(s) to %s", len(names), opts.ghOutput)
+		return nil
+	}
+
+	return opts.sink.AppendFile(opts.ghOutput, []byte(b.String()))
+}
+
+func writeJSON(sink fileSink, filePath string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return sink.WriteFile(filePath, append(data, '\n'))
+}
+
+type cacheEntry struct {
+	HeadSHA string               `json:"head_sha"`
+	Files   []prfiles.FileChange `json:"files"`
+}
+
+// cachePath returns the cache file of a pull request. -graphql lists lack
+// patches and the old paths of renames, so they are cached separately and
+// never reused by REST runs.
+func cachePath(opts *options, repo string, pr int) string {
+	name := fmt.Sprintf("%s_%d", strings.ReplaceAll(repo, "/", "_"), pr)
+	if opts.graphql {
+		name += "_graphql"
+	}
+	return filepath.Join(opts.cacheDir, name+".json")
+}
+
+func readCache(opts *options, repo string, pr int, headSHA string) ([]prfiles.FileChange, bool) {
+	if opts.cacheDir == "" || headSHA == "" {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(cachePath(opts, repo, pr))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logger.ForPR(pr).Warnf("Ignoring unreadable cache entry for PR %d: %v", pr, err)
+		return nil, false
+	}
+	if entry.HeadSHA != headSHA {
+		logger.ForPR(pr).Debugf("Cache for PR %d is stale (cached %s, head %s)", pr, entry.HeadSHA, headSHA)
+		return nil, false
+	}
+
+	logger.ForPR(pr).Debugf("Using cached files for PR %d at %s", pr, headSHA)
+	return entry.Files, true
+}
+
+func writeCache(opts *options, repo string, pr int, headSHA string, changes []prfiles.FileChange) {
+	if opts.cacheDir == "" || headSHA == "" || opts.dryRun {
+		return
+	}
+
+	if err := writeJSON(diskSink{}, cachePath(opts, repo, pr), cacheEntry{HeadSHA: headSHA, Files: changes}); err != nil {
+		logger.ForPR(pr).Warnf("Failed to write cache for PR %d: %v", pr, err)
+	}
+}
+
+// processPR processes pull request pr within -timeout-per-pr and sends its
+// result, nil if it failed. A timeout that failed the pull request is logged
+// before the result is sent, so it is reported ahead of the run summary.
+func processPR(ctx context.Context, client *prfiles.Client, repo string, pr int, opts *options, wg *sync.WaitGroup, results chan<- *prResult) {
+	defer wg.Done()
+	prCtx := ctx
+	if opts.prTimeout > 0 {
+		var cancel context.CancelFunc
+		prCtx, cancel = context.WithTimeout(ctx, opts.prTimeout)
+		defer cancel()
+	}
+	result := collectPR(prCtx, client, repo, pr, opts)
+	if (result == nil || result.incomplete) && errors.Is(prCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		logger.ForPR(pr).Errorf("PR %d exceeded -timeout-per-pr (%s)", pr, opts.prTimeout)
+	}
+	results <- result
+}
+
+// collectPR lists the files of pull request pr and writes them, returning
+// the result to report, or nil if the pull request failed.
+func collectPR(ctx context.Context, client *prfiles.Client, repo string, pr int, opts *options) *prResult {
+	prLog := logger.ForPR(pr)
+	if opts.multiRepo {
+		prLog.Infof("Processing pull request %d in %s", pr, repo)
+	} else {
+		prLog.Infof("Processing pull request %d", pr)
+	}
+
+	// With -skip-count the metadata request is only made when another
+	// option needs it; base and head branch names are then left empty.
+	pull := &prfiles.PullRequest{}
+	var err error
+	if !opts.skipCount || needsPRMetadata(opts) {
+		pull, err = prfiles.GetPR(ctx, client, repo, pr)
+		if err != nil {
+			prLog.Errorf("Failed to process PR %d: %v", pr, err)
+			return nil
+		}
+	}
+	if !opts.skipCount && opts.maxFiles > 0 && pull.ChangedFiles > opts.maxFiles {
+		prLog.Errorf("Not processing PR %d: it has %d changed files, exceeding the limit of %d (see -max-files)", pr, pull.ChangedFiles, opts.maxFiles)
+		return nil
+	}
+	if !opts.since.IsZero() && pull.UpdatedAt.Before(opts.since) {
+		prLog.Infof("Skipping PR %d: last updated %s, before -since", pr, pull.UpdatedAt.Format(time.RFC3339))
+		return &prResult{repo: repo, pr: pr, skipped: true}
+	}
+	if opts.skipDrafts && pull.Draft {
+		prLog.Infof("Skipping PR %d: it is a draft (-skip-drafts)", pr)
+		return &prResult{repo: repo, pr: pr, skipped: true}
+	}
+	if reason := labelMismatch(opts, pull.Labels); reason != "" {
+		prLog.Infof("Skipping PR %d: %s", pr, reason)
+		return &prResult{repo: repo, pr: pr, skipped: true}
+	}
+
+	// With -merge-queue, a queued pull request is listed as the queue will
+	// merge it: the changes its merge group commit makes on top of the
+	// entries ahead of it.
+	var queued *prfiles.QueueEntry
+	if opts.mergeQueue {
+		if queued, err = prfiles.MergeQueueEntry(ctx, client, repo, pr); err != nil {
+			prLog.Errorf("Failed to look up the merge queue entry of PR %d: %v", pr, err)
+			return nil
+		}
+		if queued == nil {
+			prLog.Infof("PR %d is not in a merge queue, listing the files of its branch", pr)
+		}
+	}
+
+	var incomplete bool
+	changes, cached := readCache(opts, repo, pr, pull.Head.SHA)
+	if queued != nil {
+		basehead := queued.BaseSHA + "..." + queued.HeadSHA
+		prLog.Infof("PR %d is in a merge queue (%s, position %d), comparing %s", pr, strings.ToLower(queued.State), queued.Position, basehead)
+		changes, err = prfiles.FilesInCompare(ctx, client, repo, basehead)
+		if err != nil {
+			prLog.Errorf("Failed to get files in the merge queue entry of PR %d: %v", pr, err)
+			return nil
+		}
+	} else if opts.prDiff != "" {
+		basehead := pull.Base.Ref + prDiffSeparators[opts.prDiff] + pull.Head.SHA
+		prLog.Debugf("Comparing %s for PR %d (-pr-diff %s)", basehead, pr, opts.prDiff)
+		changes, err = prfiles.FilesInCompare(ctx, client, repo, basehead)
+		if err != nil {
+			prLog.Errorf("Failed to get files in PR %d: %v", pr, err)
+			return nil
+		}
+	} else if !cached {
+		if opts.graphql {
+			changes, err = prfiles.FilesInPRGraphQL(ctx, client, repo, pr)
+		} else {
+			changes, err = prfiles.FilesInPR(ctx, client, repo, pr)
+		}
+		var incompleteErr *prfiles.IncompleteError
+		switch {
+		case errors.As(err, &incompleteErr):
+			prLog.Errorf("Files in PR %d are incomplete, writing the %d file(s) fetched so far: %v", pr, len(changes), err)
+			incomplete = true
+		case err != nil:
+			prLog.Errorf("Failed to get files in PR %d: %v", pr, err)
+			return nil
+		default:
+			writeCache(opts, repo, pr, pull.Head.SHA, changes)
+		}
+	}
+
+	listed := queued == nil && opts.prDiff == ""
+	if listed && pull.ChangedFiles > len(changes) && len(changes) >= prfiles.MaxListedFiles {
+		prLog.Errorf("PR %d has %d changed files but GitHub lists at most %d; the file list is incomplete", pr, pull.ChangedFiles, prfiles.MaxListedFiles)
+		incomplete = true
+	} else if listed && pull.ChangedFiles == 0 && len(changes) >= prfiles.MaxListedFiles {
+		prLog.Warnf("PR %d lists %d files, the most GitHub returns; the file list may be incomplete", pr, len(changes))
+	}
+	if len(changes) == 0 && !incomplete {
+		prLog.Infof("PR %d has no changed files", pr)
+	}
+
+	var generated []generatedPattern
+	if opts.generated != nil {
+		if generated, err = generatedPatterns(ctx, client, opts, repo, pull.Head.SHA); err != nil {
+			prLog.Errorf("Failed to read .gitattributes for PR %d: %v", pr, err)
+			return nil
+		}
+		changes = dropGenerated(changes, generated)
+	}
+
+	files, entries, truncated := bucketChanges(opts, changes)
+	if opts.blame != nil {
+		addAuthors(ctx, client, opts, repo, entries)
+	}
+	if truncated > 0 {
+		prLog.Warnf("Truncated %d patch(es) in PR %d to %d bytes (see -max-patch-bytes)", truncated, pr, opts.maxPatchBytes)
+	}
+
+	if opts.stdout || opts.ghOutput != "" || opts.format == "csv" || opts.onlyAggregate {
+		return &prResult{repo: repo, pr: pr, files: files, entries: entries, base: pull.Base.Ref, head: pull.Head.Ref, truncated: truncated, incomplete: incomplete}
+	}
+
+	var queueHead string
+	if queued != nil {
+		queueHead = queued.HeadSHA
+	}
+	doc := struct {
+		PR         int                  `json:"pr"`
+		Base       string               `json:"base"`
+		Head       string               `json:"head"`
+		HeadSHA    string               `json:"head_sha,omitempty"`
+		QueueHead  string               `json:"merge_queue_head,omitempty"`
+		Files      []prfiles.FileChange `json:"files"`
+		Incomplete bool                 `json:"incomplete,omitempty"`
+	}{pr, pull.Base.Ref, pull.Head.Ref, pull.Head.SHA, queueHead, entries, incomplete}
+	id := strconv.Itoa(pr)
+	if opts.shaSuffix && pull.Head.SHA != "" {
+		id += "_" + pull.Head.SHA[:min(len(pull.Head.SHA), 7)]
+	}
+	if err := writeResult(opts, repo, pr, fileID(opts, repo, id), files, entries, doc); err != nil {
+		prLog.Errorf("Failed to save files in PR %d", pr)
+		return nil
+	}
+	if opts.perCommit {
+		if err := writeCommits(ctx, client, opts, repo, pr, generated); err != nil {
+			prLog.Errorf("Failed to save the files of each commit in PR %d: %v", pr, err)
+			return nil
+		}
+	}
+
+	prLog.Infof("Files in pull request %d saved to %s", pr, opts.outputDir)
+	return &prResult{repo: repo, pr: pr, files: files, entries: entries, base: pull.Base.Ref, head: pull.Head.Ref, truncated: truncated, incomplete: incomplete}
+}
+
+// writeCommits writes the files changed by each commit of pull request pr,
+// named {pr}_{sha}, with the short SHA, for -per-commit. Files matching the
+// pull request's generated patterns are left out.
+func writeCommits(ctx context.Context, client *prfiles.Client, opts *options, repo string, pr int, generated []generatedPattern) error {
+	shas, err := prfiles.PRCommits(ctx, client, repo, pr)
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		changes, err := prfiles.FilesInCommit(ctx, client, repo, sha)
+		if err != nil {
+			return fmt.Errorf("commit %s: %w", sha, err)
+		}
+		files, entries, _ := bucketChanges(opts, dropGenerated(changes, generated))
+		doc := struct {
+			PR     int                  `json:"pr"`
+			Commit string               `json:"commit"`
+			Files  []prfiles.FileChange `json:"files"`
+		}{pr, sha, entries}
+		id := fmt.Sprintf("%d_%s", pr, sha[:min(len(sha), 7)])
+		if err := writeResult(opts, repo, pr, fileID(opts, repo, id), files, entries, doc); err != nil {
+			return err
+		}
 	}
+	logger.ForPR(pr).Infof("Files of %d commit(s) in pull request %d saved to %s", len(shas), pr, opts.outputDir)
+	return nil
 }
 
-func doGitHubRequest(url string, token string) ([]byte, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+// writeResult writes the bucketed files of a single pull request or
+// comparison to the output directory. id names the output files, or their
+// subdirectory with -per-pr-dir, and doc is the document written with
+// -format json. repo and pr are recorded in the -manifest, with a pr of 0
+// for comparisons and commits.
+func writeResult(opts *options, repo string, pr int, id string, files map[string][]string, entries []prfiles.FileChange, doc any) error {
+	dir := filepath.Join(opts.outputDir, id)
+	if opts.perPRDir && !opts.dryRun {
+		if err := opts.sink.MkdirAll(dir); err != nil {
+			logger.Errorf("Failed to create directory %s: %v", dir, err)
+			return err
+		}
 	}
 
-	for key, value := range githubHeaders(token) {
-		req.Header.Set(key, value)
+	var errs []error
+
+	switch opts.format {
+	case "json":
+		filePath := filepath.Join(opts.outputDir, id+".json")
+		if opts.perPRDir {
+			filePath = filepath.Join(dir, "files.json")
+		}
+		if err := writeOutputJSON(opts, filePath, doc); err != nil {
+			logger.Errorf("Failed to write file %s: %v", filePath, err)
+			errs = append(errs, err)
+		} else {
+			recordOutput(opts, repo, pr, "json", filePath, len(entries))
+		}
+	default:
+		for name, content := range files {
+			filePath := filepath.Join(dir, name+".txt")
+			if !opts.perPRDir {
+				var err error
+				if filePath, err = outputPath(opts, id, name); err != nil {
+					logger.Errorf("Failed to build output path for %s: %v", id, err)
+					errs = append(errs, err)
+					continue
+				}
+			}
+			if err := writeOutputFile(opts, filePath, content); err != nil {
+				logger.Errorf("Failed to write file %s: %v", filePath, err)
+				errs = append(errs, err)
+				continue
+			}
+			recordOutput(opts, repo, pr, name, filePath, len(content))
+		}
+		if opts.withPatch {
+			errs = append(errs, writePatches(opts, repo, pr, id, entries))
+		}
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+	if opts.checksum {
+		filePath := filepath.Join(opts.outputDir, id+".sha256")
+		if opts.perPRDir {
+			filePath = filepath.Join(dir, "checksum.sha256")
+		}
+		if err := writeChecksum(opts, repo, pr, filePath, entries); err != nil {
+			logger.Errorf("Failed to write file %s: %v", filePath, err)
+			errs = append(errs, err)
+		}
 	}
-	defer resp.Body.Close()
+	return errors.Join(errs...)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+// runCompare writes the files changed between two refs, given as
+// "base...head", using the same bucketing and output formats as pull
+// requests. Output files are named after the comparison. It returns the
+// filtered entries that were written.
+func runCompare(ctx context.Context, client *prfiles.Client, repo string, basehead string, opts *options) ([]prfiles.FileChange, error) {
+	logger.Infof("Comparing %s", basehead)
+	changes, err := prfiles.FilesInCompare(ctx, client, repo, basehead)
+	if err != nil {
+		return nil, err
 	}
+	return writeRefFiles(opts, basehead, changes, func(entries []prfiles.FileChange) any {
+		return struct {
+			Compare string               `json:"compare"`
+			Files   []prfiles.FileChange `json:"files"`
+		}{basehead, entries}
+	})
+}
 
-	return io.ReadAll(resp.Body)
+// runCommit lists the files changed by a single commit and writes them like
+// runCompare, named after the commit SHA.
+func runCommit(ctx context.Context, client *prfiles.Client, repo string, sha string, opts *options) ([]prfiles.FileChange, error) {
+	logger.Infof("Listing files in commit %s", sha)
+	changes, err := prfiles.FilesInCommit(ctx, client, repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	return writeRefFiles(opts, sha, changes, func(entries []prfiles.FileChange) any {
+		return struct {
+			Commit string               `json:"commit"`
+			Files  []prfiles.FileChange `json:"files"`
+		}{sha, entries}
+	})
 }
 
-func filesInPR(repo string, pr int, token string) (map[string]string, error) {
-	filesMap := make(map[string]string)
-	page := 1
+// writeRefFiles buckets changes that are not tied to a pull request and
+// writes them to the configured output. name labels the output files, with
+// "/" replaced by "_", and newDoc builds the JSON document from the entries.
+func writeRefFiles(opts *options, name string, changes []prfiles.FileChange, newDoc func([]prfiles.FileChange) any) ([]prfiles.FileChange, error) {
+	files, entries, truncated := bucketChanges(opts, changes)
+	if truncated > 0 {
+		logger.Warnf("Truncated %d patch(es) in %s to %d bytes (see -max-patch-bytes)", truncated, name, opts.maxPatchBytes)
+	}
+	doc := newDoc(entries)
 
-	for {
-		url := fmt.Sprintf("%s/repos/%s/pulls/%d/files?page=%d&per_page=%d", githubAPIURL, repo, pr, page, perPage)
-		bodyText, err := doGitHubRequest(url, token)
-		if err != nil {
-			return nil, err
+	switch {
+	case opts.ghOutput != "":
+		if err := writeGitHubOutput(opts, files); err != nil {
+			return nil, fmt.Errorf("failed to write step outputs: %w", err)
 		}
-
-		var files []struct {
-			Filename string `json:"filename"`
-			Status   string `json:"status"`
+		logger.Infof("Step outputs appended to %s", opts.ghOutput)
+	case opts.stdout && opts.format == "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
 		}
-		if err := json.Unmarshal(bodyText, &files); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	case opts.stdout:
+		printFiles(opts, files["all"])
+	default:
+		if err := writeResult(opts, "", 0, strings.ReplaceAll(name, "/", "_"), files, entries, doc); err != nil {
+			return nil, fmt.Errorf("failed to save files: %w", err)
 		}
+		logger.Infof("Files in %s saved to %s", name, opts.outputDir)
+	}
+	return entries, nil
+}
 
-		if len(files) == 0 {
-			break
-		}
+// needsPRMetadata reports whether options other than -max-files require
+// the pull request metadata (updated time, draft flag, head and base).
+func needsPRMetadata(opts *options) bool {
+	return !opts.since.IsZero() || opts.skipDrafts || opts.cacheDir != "" || opts.prDiff != "" || opts.shaSuffix || opts.generated != nil ||
+		len(opts.requireLabels) > 0 || len(opts.skipLabels) > 0
+}
 
-		for _, file := range files {
-			switch file.Status {
-			case "modified", "added":
-				filesMap[file.Filename] = "changed"
-			case "deleted":
-				filesMap[file.Filename] = "deleted"
+// labelMismatch returns why a pull request with labels is excluded by
+// -require-label or -skip-label, or an empty string if it is not.
+func labelMismatch(opts *options, labels []prfiles.Label) string {
+	has := func(want string) bool {
+		for _, label := range labels {
+			if label.Name == want || opts.labelFold && strings.EqualFold(label.Name, want) {
+				return true
 			}
-			log.Printf("[DEBUG] File in PR %d: %s (Status: %s)", pr, file.Filename, file.Status)
 		}
-		page++
+		return false
+	}
+	for _, want := range opts.requireLabels {
+		if !has(want) {
+			return fmt.Sprintf("it is not labeled %q (-require-label)", want)
+		}
+	}
+	for _, skip := range opts.skipLabels {
+		if has(skip) {
+			return fmt.Sprintf("it is labeled %q (-skip-label)", skip)
+		}
 	}
+	return ""
+}
 
-	return filesMap, nil
+// parseLabels splits a comma-separated list of label names.
+func parseLabels(value string) []string {
+	var labels []string
+	for _, label := range strings.Split(value, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
 }
 
-func writeFile(filePath string, filenames []string) error {
-	data := strings.Join(filenames, "\n")
-	return os.WriteFile(filePath, []byte(data), 0644)
+// ndjsonRecord is one line of -format ndjson output.
+type ndjsonRecord struct {
+	Repo string `json:"repo,omitempty"`
+	PR   int    `json:"pr"`
+	prfiles.FileChange
 }
 
-func filesChangedCount(repo string, pr int, token string) (int, error) {
-	url := fmt.Sprintf("%s/repos/%s/pulls/%d", githubAPIURL, repo, pr)
-	bodyText, err := doGitHubRequest(url, token)
-	if err != nil {
-		return -1, err
+// writeNDJSON writes one JSON line per file in result. It is only called
+// from the results loop, so writes from concurrent pull requests never
+// interleave.
+func writeNDJSON(enc *json.Encoder, repo string, result *prResult) error {
+	for _, entry := range result.entries {
+		if err := enc.Encode(ndjsonRecord{repo, result.pr, entry}); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// prDiffSeparators maps the -pr-diff values to compare API separators.
+var prDiffSeparators = map[string]string{
+	"two-dot":   "..",
+	"three-dot": "...",
+}
 
-	var body map[string]interface{}
-	if err := json.Unmarshal(bodyText, &body); err != nil {
-		return -1, fmt.Errorf("failed to unmarshal response: %w", err)
+// diffFileSets compares the files of two pull requests. "added-only" lists
+// files only in a, "removed-only" files only in b, and "both" lists each side
+// with a "< " (only in a) or "> " (only in b) prefix, like comm.
+func diffFileSets(a, b []prfiles.FileChange, mode string) []string {
+	inA := make(map[string]bool, len(a))
+	for _, entry := range a {
+		inA[entry.Filename] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, entry := range b {
+		inB[entry.Filename] = true
 	}
 
-	if changedFilesFloat, ok := body["changed_files"].(float64); ok {
-		return int(changedFilesFloat), nil
+	var names []string
+	prefixes := make(map[string]string)
+	if mode != "removed-only" {
+		for name := range inA {
+			if !inB[name] {
+				names = append(names, name)
+				prefixes[name] = "< "
+			}
+		}
+	}
+	if mode != "added-only" {
+		for name := range inB {
+			if !inA[name] {
+				names = append(names, name)
+				prefixes[name] = "> "
+			}
+		}
 	}
+	sort.Strings(names)
 
-	log.Printf("[WARN] No changed files in pull request %d", pr)
-	return 0, nil
+	if mode != "both" {
+		return names
+	}
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = prefixes[name] + name
+	}
+	return lines
 }
 
-func processPR(repo string, pr int, token string, outputDir string, wg *sync.WaitGroup, results chan<- map[string][]string) {
-	defer wg.Done()
-	log.Printf("[INFO] Processing pull request %d", pr)
+// runDiffPRs writes the difference between the changed files of pull
+// requests a and b to diff_{a}_{b}.txt, or to standard output with -stdout.
+func runDiffPRs(ctx context.Context, client *prfiles.Client, repo string, a, b int, mode string, opts *options) error {
+	logger.Infof("Comparing the files of pull requests %d and %d", a, b)
+	var sides [2][]prfiles.FileChange
+	for i, pr := range []int{a, b} {
+		changes, err := prfiles.FilesInPR(ctx, client, repo, pr)
+		if err != nil {
+			return fmt.Errorf("failed to get files in PR %d: %w", pr, err)
+		}
+		_, sides[i], _ = bucketChanges(opts, changes)
+	}
 
-	count, err := filesChangedCount(repo, pr, token)
-	if err != nil || count > maxChangedFiles {
-		log.Printf("[ERROR] Failed to process PR %d: %v", pr, err)
-		results <- nil
-		return
+	lines := diffFileSets(sides[0], sides[1], mode)
+	if opts.stdout {
+		printFiles(opts, lines)
+		return nil
 	}
 
-	filesMap, err := filesInPR(repo, pr, token)
-	if err != nil {
-		log.Printf("[ERROR] Failed to get files in PR %d: %v", pr, err)
-		results <- nil
-		return
+	filePath := filepath.Join(opts.outputDir, fmt.Sprintf("diff_%d_%d.txt", a, b))
+	if err := writeOutputFile(opts, filePath, lines); err != nil {
+		return err
 	}
+	recordOutput(opts, "", 0, "diff", filePath, len(lines))
+	logger.Infof("Difference saved to %s", filePath)
+	return nil
+}
+
+// bucketChanges filters changes and sorts the remaining files into the all,
+// chg, del, and ren buckets, returning the lines for each bucket alongside the
+// filtered entries and the number of patches cut to -max-patch-bytes.
+func bucketChanges(opts *options, changes []prfiles.FileChange) (map[string][]string, []prfiles.FileChange, int) {
+	truncated := 0
+	var changedFiles, deletedFiles, renamedFiles, binaryFiles, allFiles []string
+	entries := make([]prfiles.FileChange, 0, len(changes))
+	for _, entry := range changes {
+		category := entry.Category()
+		if category == "" {
+			if entry.Status != "unchanged" {
+				logger.Warnf("Ignoring %s: unknown file status %q", entry.Filename, entry.Status)
+			}
+			continue
+		}
+		if !matchFilters(entry.Filename, opts.includes, opts.excludes) {
+			continue
+		}
+		if opts.filterRegex != nil && !opts.filterRegex.MatchString(entry.Filename) {
+			continue
+		}
+		if opts.stripPrefix != "" {
+			name, ok := strings.CutPrefix(entry.Filename, opts.stripPrefix)
+			if !ok && !opts.keepUnprefixed {
+				continue
+			}
+			entry.Filename = name
+			if old, ok := strings.CutPrefix(entry.PreviousFilename, opts.stripPrefix); ok {
+				entry.PreviousFilename = old
+			}
+		}
+		entry.Status = category
+		entry.Binary = opts.markBinary && entry.LooksBinary()
+		if !opts.withPatch {
+			entry.Patch = ""
+		}
+		if !opts.withURLs {
+			entry.RawURL, entry.BlobURL, entry.ContentsURL = "", "", ""
+		}
+		if patch, ok := truncatePatch(entry.Patch, opts.maxPatchBytes); ok {
+			entry.Patch = patch
+			truncated++
+		}
+		if hasControlChars(entry.Filename) || hasControlChars(entry.PreviousFilename) {
+			if opts.escapeNames {
+				entry.Filename = escapeControlChars(entry.Filename)
+				entry.PreviousFilename = escapeControlChars(entry.PreviousFilename)
+			} else {
+				logger.Warnf("File name %q contains newline or control characters and will break line-based output (see -flatten-newlines)", entry.Filename)
+			}
+		}
+		entries = append(entries, entry)
 
-	var changedFiles, deletedFiles, allFiles []string
-	for file, status := range filesMap {
-		switch status {
-		case "changed":
-			changedFiles = append(changedFiles, file)
-		case "deleted":
-			deletedFiles = append(deletedFiles, file)
+		line := formatLine(entry, opts.counts)
+		switch {
+		case entry.Binary:
+			binaryFiles = append(binaryFiles, line)
+		case category == prfiles.CategoryChanged:
+			changedFiles = append(changedFiles, line)
+		case category == prfiles.CategoryDeleted:
+			deletedFiles = append(deletedFiles, line)
+		case category == prfiles.CategoryRenamed:
+			changedFiles = append(changedFiles, line)
+			if opts.renameAsDel && entry.PreviousFilename != "" {
+				deletedFiles = append(deletedFiles, formatLine(prfiles.FileChange{Filename: entry.PreviousFilename}, opts.counts))
+			}
+			if entry.PreviousFilename != "" {
+				renamedFiles = append(renamedFiles, entry.PreviousFilename+" -> "+entry.Filename)
+			}
 		}
-		allFiles = append(allFiles, file)
+		allFiles = append(allFiles, line)
 	}
 
 	files := map[string][]string{
 		"all": allFiles,
 	}
-	if len(changedFiles) > 0 {
+	if len(changedFiles) > 0 || opts.alwaysWrite {
 		files["chg"] = changedFiles
 	}
-	if len(deletedFiles) > 0 {
+	if len(deletedFiles) > 0 || opts.alwaysWrite {
 		files["del"] = deletedFiles
 	}
+	if len(renamedFiles) > 0 || opts.alwaysWrite {
+		files["ren"] = renamedFiles
+	}
+	if len(binaryFiles) > 0 || (opts.alwaysWrite && opts.markBinary) {
+		files["bin"] = binaryFiles
+	}
 
+	collapseDirs(files, opts.collapseDirs)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Filename < entries[j].Filename })
+	for _, content := range files {
+		sort.Strings(content)
+	}
+	return files, entries, truncated
+}
+
+// collapseDirs replaces the paths in every bucket but "ren" with the unique
+// set of their directories, cut to the first depth components. Files at the
+// top level collapse to ".". A depth of 0 leaves files untouched.
+func collapseDirs(files map[string][]string, depth int) {
+	if depth <= 0 {
+		return
+	}
 	for name, content := range files {
-		filePath := filepath.Join(outputDir, fmt.Sprintf("%d_%s.txt", pr, name))
-		if err := writeFile(filePath, content); err != nil {
-			log.Printf("[ERROR] Failed to write file %s: %v", filePath, err)
+		if name == "ren" {
+			continue
+		}
+		dirs := make([]string, 0, len(content))
+		for _, file := range content {
+			parts := strings.Split(path.Dir(file), "/")
+			if len(parts) > depth {
+				parts = parts[:depth]
+			}
+			dirs = append(dirs, strings.Join(parts, "/"))
 		}
+		files[name] = compactSorted(dirs)
 	}
-
-	log.Printf("[INFO] Files in pull request %d saved to %s", pr, outputDir)
-	results <- files
 }
 
 func main() {
-	repo := flag.String("repo", "", "Full name of the repository in the format 'owner/name'")
-	pullRequests := flag.String("pulls", "", "Comma-separated list of pull request numbers")
-	token := flag.String("token", "", "GitHub API token")
+	repo := flag.String("repo", "", "Full name of the repository in the format 'owner/name', or a comma-separated list of repositories")
+	repoFromGitRemote := flag.Bool("repo-from-git", false, "Infer the repository from the origin remote of the git repository in the working directory, falling back to -repo")
+	pullRequests := flag.String("pulls", "", "Comma-separated list of pull request numbers or ranges (e.g. 100-120,130), or '-' to read them from stdin")
+	prDiff := flag.String("pr-diff", "", "List pull request files with the compare API instead of the pull request files endpoint: 'three-dot' (changes on the head branch since it diverged from the base branch) or 'two-dot' (every difference between the current base branch and the head)")
+	diffPRs := flag.String("diff-prs", "", "Write the files changed by one pull request but not the other, given as 'A,B' (see -diff-mode)")
+	diffMode := flag.String("diff-mode", "added-only", "With -diff-prs: 'added-only' (files only in A), 'removed-only' (files only in B), or 'both'")
+	compare := flag.String("compare", "", "Compare two refs given as 'base...head' instead of processing pull requests")
+	commit := flag.String("commit", "", "List the files changed by a single commit SHA instead of processing pull requests")
+	query := flag.String("query", "", "Process the pull requests matching this search query (e.g. 'is:open label:ready') instead of -pulls; 'repo:' is added for each -repo")
+	state := flag.String("state", "", "Process every pull request in this state ('open', 'closed', or 'all') instead of -pulls; '-pulls all-open' is shorthand for '-state open'")
+	pullsFile := flag.String("pulls-file", "", "File containing pull request numbers, one per line ('#' starts a comment)")
+	token := flag.String("token", "", "GitHub API token (defaults to -token-file or -token-env, then $GITHUB_TOKEN or $GH_TOKEN)")
+	tokenEnv := flag.String("token-env", "", "Read the GitHub API token from this environment variable, e.g. MY_PAT")
+	tokenList := flag.String("tokens", "", "Comma-separated GitHub API tokens to use in turn, switching away from a token while its rate limit is exhausted")
+	tokenFile := flag.String("token-file", "", "Read the GitHub API token from this file instead of passing it on the command line")
+	appID := flag.String("app-id", "", "GitHub App ID to authenticate as an app installation instead of using -token")
+	appPrivateKey := flag.String("app-private-key", "", "Path to the GitHub App's PEM-encoded private key")
+	installationID := flag.Int64("installation-id", 0, "GitHub App installation ID")
+	requestTimeout := flag.Duration("request-timeout", prfiles.DefaultRequestTimeout, "Timeout for each API request; timed-out requests are retried (see -timeout for the whole run)")
+	perPage := flag.Int("per-page", prfiles.MaxPerPage, "Page size for paginated API requests (1-100)")
+	userAgent := flag.String("user-agent", "", "Override the User-Agent header sent to the GitHub API")
+	retrySecondary := flag.Bool("retry-on-secondary-limit", true, "Wait out GitHub's secondary (abuse detection) rate limit, honoring Retry-After or waiting a minute plus jitter, bounded by -max-wait")
+	apiVersion := flag.String("api-version", prfiles.DefaultAPIVersion, "X-GitHub-Api-Version header sent to the GitHub API; empty omits the header")
+	apiURL := flag.String("api-url", prfiles.DefaultAPIURL, "Base URL of the GitHub API (e.g. https://ghe.example.com/api/v3 for GitHub Enterprise Server)")
+	maxWait := flag.Duration("max-wait", 5*time.Minute, "Maximum time to wait for GitHub rate limits to reset before failing a request")
+	retries := flag.Int("retries", prfiles.DefaultRetryPolicy().MaxAttempts, "Maximum number of attempts for requests that fail with a network error or 5xx response")
+	retryBaseDelay := flag.Duration("retry-base-delay", prfiles.DefaultRetryPolicy().BaseDelay, "Delay before the first retry of a failed request, doubled for each later retry")
+	retryMaxDelay := flag.Duration("retry-max-delay", 0, "Cap on the doubled retry delay, before jitter (0 for no cap)")
+	retryJitter := flag.Float64("retry-jitter", prfiles.DefaultRetryPolicy().Jitter, "Random extra retry delay, as a fraction of the delay from 0 (disabled) to 1")
+	concurrency := flag.Int("concurrency", 4, "Maximum number of pull requests to process concurrently")
 	outputDir := flag.String("output-dir", ".", "Directory to save output files (default is current directory)")
+	format := flag.String("format", "text", "Output format: 'text' (one file per bucket), 'json' (one document per PR), 'csv' (one combined all.csv), or 'ndjson' (one JSON object per file, streamed to stdout)")
+	counts := flag.Bool("counts", false, "Append tab-separated additions, deletions, and changes to each filename in text output")
+	timeout := flag.Duration("timeout", 0, "Maximum duration of the whole run (0 means no limit)")
+	timeoutPerPR := flag.Duration("timeout-per-pr", 0, "Maximum time spent on each pull request; one that takes longer fails without stopping the others (0 means no limit)")
+	stdout := flag.Bool("stdout", false, "Write results to standard output instead of files in -output-dir")
+	githubOutput := flag.Bool("github-output", false, "Append the aggregate all, chg, del, and ren lists as step outputs to $GITHUB_OUTPUT instead of writing files")
+	maxFiles := flag.Int("max-files", maxChangedFiles, "Fail pull requests with more changed files than this without listing them (0 means unlimited)")
+	strict := flag.Bool("strict", false, "Abort the whole run as soon as any pull request fails")
+	include := flag.String("include", "", "Comma-separated glob patterns; only matching paths are reported")
+	exclude := flag.String("exclude", "", "Comma-separated glob patterns; matching paths are dropped (takes precedence over -include)")
+	failOnDeleted := flag.String("fail-on-deleted", "", "Comma-separated glob patterns; exit non-zero if a pull request deletes a matching file")
+	filterRegex := flag.String("filter-regex", "", "Go regular expression that must match the whole path for a file to be reported")
+	withPatch := flag.Bool("with-patch", false, "Save each file's diff as {pr}_{path}.patch (text format) or include it in the JSON output")
+	maxPatchBytes := flag.Int("max-patch-bytes", 0, "Truncate patches longer than this many bytes, appending a '... [truncated]' marker (0 for no limit)")
+	skipDrafts := flag.Bool("skip-drafts", false, "Skip draft pull requests")
+	requireLabel := flag.String("require-label", "", "Only process pull requests that have all of these comma-separated labels")
+	skipLabel := flag.String("skip-label", "", "Skip pull requests that have any of these comma-separated labels")
+	labelIgnoreCase := flag.Bool("label-ignore-case", false, "Match -require-label and -skip-label case-insensitively")
+	skipCount := flag.Bool("skip-count", false, "Don't fetch pull request metadata just to check -max-files; disables the limit and, unless -since, -skip-drafts, -require-label, -skip-label, -cache-dir, -pr-diff, -sha-suffix or -exclude-generated need it, leaves base and head out of JSON output")
+	since := flag.String("since", "", "Only process pull requests updated at or after this RFC3339 timestamp (e.g. 2024-06-01T00:00:00Z)")
+	cacheDir := flag.String("cache-dir", "", "Directory for caching PR file lists between runs, keyed by the PR's head commit")
+	markBinary := flag.Bool("mark-binary", false, "List files that look binary (no patch and no line changes) in a separate 'bin' bucket instead of the changed and deleted lists")
+	collapse := flag.Int("collapse-dirs", 0, "List the unique directories that changed, cut to this many leading path components, instead of individual files (text format only)")
+	withStatus := flag.Bool("with-status", false, "Prefix each line of the aggregate files with the file's status and a tab")
+	summaryPath := flag.String("summary", "", "Write per pull request file counts to this path (JSON if it ends in .json), or '-' to print them")
+	stripPrefix := flag.String("strip-prefix", "", "Remove this leading directory from file paths in all output, dropping files outside it (see -keep-unprefixed)")
+	keepUnprefixed := flag.Bool("keep-unprefixed", false, "With -strip-prefix, keep files outside the prefix with their full path instead of dropping them")
+	mergeQueue := flag.Bool("merge-queue", false, "For pull requests in a merge queue, list the files their gh-readonly-queue merge group commit changes instead of the pull request branch; others are listed as usual")
+	graphql := flag.Bool("graphql", false, "List pull request files with the GraphQL API, which has its own rate limit, instead of REST; patches and the old paths of renamed files are not available")
+	perCommit := flag.Bool("per-commit", false, "Also write the files changed by each commit of a pull request, as {pr}_{sha}_{bucket}.txt")
+	renameAsDelete := flag.Bool("rename-as-delete-add", false, "Also list the old path of each renamed file with the deleted files, treating a rename as a delete plus an add")
+	shaSuffix := flag.Bool("sha-suffix", false, "Add the short head commit SHA to each pull request's output filenames, e.g. 123_abc1234_chg.txt")
+	withURLs := flag.Bool("with-urls", false, "Include each file's raw_url, blob_url, and contents_url in JSON and NDJSON output, for fetching its contents afterwards")
+	withBlame := flag.Bool("with-blame", false, "Add the author of the last commit touching each file on the default branch to JSON and CSV output (one extra API request per file)")
+	appendAggregates := flag.Bool("append", false, "Merge the aggregate all_*.txt files with the ones left by earlier runs instead of overwriting them (text format only)")
+	excludeGenerated := flag.Bool("exclude-generated", false, "Leave out files marked linguist-generated in the repository's root .gitattributes at the pull request head")
+	checksum := flag.Bool("checksum", false, "Also write the sha256 of each pull request's sorted file names and statuses to {pr}.sha256, and of the aggregate to all.sha256, to detect changes between runs")
+	manifestPath := flag.String("manifest", "", "Write a JSON index of every output file with its pull request, bucket, and line count to this path")
+	statsPath := flag.String("stats", "", "Write file counts by extension to this path (JSON if it ends in .json), or '-' to print them")
+	alwaysWrite := flag.Bool("always-write", false, "Write every bucket file for each pull request, even when it is empty")
+	dryRun := flag.Bool("dry-run", false, "Log the files that would be written without touching disk")
+	repoDirs := flag.Bool("output-dir-per-repo", false, "Write each repository's files to {output-dir}/{owner}/{name}/ instead of prefixing filenames with the repository")
+	print0 := flag.Bool("print0", false, "Terminate file names with NUL instead of newline in text output, for xargs -0 (text format only)")
+	flattenNewlines := flag.Bool("flatten-newlines", false, "Escape newlines and other control characters in file names (as \\n, \\t, ...) so each file stays on one line")
+	noAggregate := flag.Bool("no-aggregate", false, "Skip the aggregate all_*.txt and all.json files")
+	onlyAggregate := flag.Bool("only-aggregate", false, "Write only the aggregate files, skipping per pull request files")
+	perPRDir := flag.Bool("per-pr-dir", false, "Write each pull request's files to {output-dir}/{pr}/ (all.txt, chg.txt, ...) instead of prefixed filenames")
+	nameTemplate := flag.String("name-template", defaultNameTemplate, "Go text/template for text output filenames; fields: {{.PR}} (number, or 'all' for aggregates) and {{.Bucket}} (all, chg, del, ren)")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn, or error")
+	logFormat := flag.String("log-format", "text", "Log format: 'text' or 'json' (one object per line with time, level, msg, and pr fields)")
+	verbose := flag.Bool("v", false, "Verbose logging (same as -log-level debug)")
+	quiet := flag.Bool("q", false, "Quiet logging, errors only (same as -log-level error)")
 	flag.Parse()
 
-	if *repo == "" || *pullRequests == "" || *token == "" {
-		log.Println("[ERROR] Missing required flags:")
+	level, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	switch {
+	case *verbose:
+		level = logger.LevelDebug
+	case *quiet:
+		level = logger.LevelError
+	}
+	logger.SetLevel(level)
+	if err := logger.SetFormat(*logFormat); err != nil {
+		logger.Fatalf("%v", err)
+	}
+	if err := validateFlags(); err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	tokenSource := "-token flag"
+	var tokens []string
+	if *tokenList != "" {
+		for _, t := range strings.Split(*tokenList, ",") {
+			if t = strings.TrimSpace(t); t != "" && !slices.Contains(tokens, t) {
+				tokens = append(tokens, t)
+			}
+		}
+		if len(tokens) == 0 {
+			logger.Fatalf("-tokens contains no tokens")
+		}
+		*token = tokens[0]
+		tokenSource = fmt.Sprintf("-tokens, %d token(s)", len(tokens))
+	}
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			logger.Fatalf("Failed to read token file: %v", err)
+		}
+		*token = strings.TrimSpace(string(data))
+		if *token == "" {
+			logger.Fatalf("Token file %s is empty", *tokenFile)
+		}
+		tokenSource = "-token-file " + *tokenFile
+	}
+	if *tokenEnv != "" {
+		*token = strings.TrimSpace(os.Getenv(*tokenEnv))
+		if *token == "" {
+			logger.Fatalf("Environment variable %s named by -token-env is unset or empty", *tokenEnv)
+		}
+		tokenSource = "$" + *tokenEnv
+	}
+	if *token == "" {
+		for _, env := range []string{"GITHUB_TOKEN", "GH_TOKEN"} {
+			if value := os.Getenv(env); value != "" {
+				*token = value
+				tokenSource = "$" + env
+				break
+			}
+		}
+	}
+
+	if *pullRequests == "all-open" {
+		*pullRequests, *state = "", "open"
+	}
+
+	useApp := *appID != "" && *appPrivateKey != "" && *installationID != 0
+	if useApp {
+		tokenSource = "GitHub App installation " + strconv.FormatInt(*installationID, 10)
+	}
+
+	if *repoFromGitRemote {
+		inferred, err := repoFromGit()
+		switch {
+		case err == nil:
+			logger.Debugf("Using repository %s from the origin remote", inferred)
+			*repo = inferred
+		case *repo != "":
+			logger.Warnf("Failed to infer the repository from git, using -repo: %v", err)
+		default:
+			logger.Fatalf("Failed to infer the repository from git: %v", err)
+		}
+	}
+
+	if *repo == "" || (*pullRequests == "" && *pullsFile == "" && *state == "" && *query == "" && *compare == "" && *commit == "" && *diffPRs == "") || (*token == "" && !useApp) {
+		logger.Errorf("Missing required flags:")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	if err := os.MkdirAll(*outputDir, 0755); err != nil {
-		log.Fatalf("[ERROR] Failed to create output directory: %v", err)
+	repos, err := parseRepos(*repo)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	if *format != "text" && *format != "json" && *format != "csv" && *format != "ndjson" {
+		logger.Fatalf("Invalid output format: %s", *format)
+	}
+	if *format == "ndjson" {
+		// NDJSON is only ever streamed to stdout.
+		*stdout = true
+	}
+
+	if *state != "" && *state != "open" && *state != "closed" && *state != "all" {
+		logger.Fatalf("Invalid pull request state: %s", *state)
+	}
+
+	if *compare != "" {
+		base, head, ok := strings.Cut(*compare, "...")
+		if !ok || base == "" || head == "" {
+			logger.Fatalf("Invalid -compare %q: expected 'base...head'", *compare)
+		}
+		if len(repos) > 1 {
+			logger.Fatalf("-compare supports a single repository")
+		}
+	}
+
+	if *commit != "" {
+		if len(repos) > 1 {
+			logger.Fatalf("-commit supports a single repository")
+		}
+	}
+
+	var diffA, diffB int
+	if *diffPRs != "" {
+		pair, err := parsePRList(strings.NewReader(*diffPRs), "-diff-prs")
+		if err != nil || len(pair) != 2 {
+			logger.Fatalf("Invalid -diff-prs %q: expected two pull request numbers 'A,B'", *diffPRs)
+		}
+		diffA, diffB = pair[0], pair[1]
+		if *diffMode != "added-only" && *diffMode != "removed-only" && *diffMode != "both" {
+			logger.Fatalf("Invalid -diff-mode: %s", *diffMode)
+		}
+		if len(repos) > 1 {
+			logger.Fatalf("-diff-prs supports a single repository")
+		}
+	}
+
+	var ghOutput string
+	if *githubOutput {
+		if len(repos) > 1 {
+			logger.Fatalf("-github-output supports a single repository")
+		}
+		ghOutput = os.Getenv("GITHUB_OUTPUT")
+		if ghOutput == "" {
+			logger.Fatalf("-github-output requires the GITHUB_OUTPUT environment variable")
+		}
+	}
+
+	if *collapse < 0 {
+		logger.Fatalf("-collapse-dirs must not be negative")
+	}
+	if _, ok := prDiffSeparators[*prDiff]; *prDiff != "" && !ok {
+		logger.Fatalf("Invalid -pr-diff: %s", *prDiff)
+	}
+	nameTmpl, err := parseNameTemplate(*nameTemplate)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	includes, err := parsePatterns(*include)
+	if err != nil {
+		logger.Fatalf("Invalid -include: %v", err)
+	}
+	excludes, err := parsePatterns(*exclude)
+	if err != nil {
+		logger.Fatalf("Invalid -exclude: %v", err)
+	}
+	deletedPatterns, err := parsePatterns(*failOnDeleted)
+	if err != nil {
+		logger.Fatalf("Invalid -fail-on-deleted: %v", err)
+	}
+
+	var sinceTime time.Time
+	if *since != "" {
+		sinceTime, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			logger.Fatalf("Invalid -since timestamp: %v", err)
+		}
+	}
+
+	var pathRegex *regexp.Regexp
+	if *filterRegex != "" {
+		pathRegex, err = regexp.Compile("^(?:" + *filterRegex + ")$")
+		if err != nil {
+			logger.Fatalf("Invalid -filter-regex: %v", err)
+		}
+	}
+
+	var sink fileSink = diskSink{}
+	if !*stdout && ghOutput == "" && !*dryRun {
+		if err := sink.MkdirAll(*outputDir); err != nil {
+			logger.Fatalf("Failed to create output directory: %v", err)
+		}
+		if err := sink.CheckWritable(*outputDir); err != nil {
+			logger.Fatalf("Output directory is not writable: %v", err)
+		}
+	}
+	if *cacheDir != "" && !*dryRun {
+		if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+			logger.Fatalf("Failed to create cache directory: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *timeout)
+		defer cancelTimeout()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client := prfiles.NewClient(*apiURL, *token, *maxWait, *retries)
+	if len(tokens) > 1 {
+		client.SetAuthenticator(prfiles.NewTokenPool(tokens))
+	}
+	if *userAgent != "" {
+		client.SetUserAgent(*userAgent)
+	}
+	client.SetAPIVersion(*apiVersion)
+	client.SetRetrySecondaryLimit(*retrySecondary)
+	if *retryBaseDelay < 0 || *retryMaxDelay < 0 {
+		logger.Fatalf("-retry-base-delay and -retry-max-delay must not be negative")
+	}
+	if !(*retryJitter >= 0 && *retryJitter <= 1) {
+		logger.Fatalf("-retry-jitter must be between 0 and 1, got %v", *retryJitter)
+	}
+	client.SetRetryPolicy(prfiles.RetryPolicy{
+		MaxAttempts: *retries,
+		BaseDelay:   *retryBaseDelay,
+		MaxDelay:    *retryMaxDelay,
+		Jitter:      *retryJitter,
+	})
+	if *perPage < 1 || *perPage > prfiles.MaxPerPage {
+		clamped := min(max(*perPage, 1), prfiles.MaxPerPage)
+		logger.Warnf("-per-page %d is out of range 1-%d, using %d", *perPage, prfiles.MaxPerPage, clamped)
+		*perPage = clamped
+	}
+	client.SetPerPage(*perPage)
+	client.SetRequestTimeout(*requestTimeout)
+	if useApp {
+		keyPEM, err := os.ReadFile(*appPrivateKey)
+		if err != nil {
+			logger.Fatalf("Failed to read app private key: %v", err)
+		}
+		app, err := prfiles.NewAppAuth(*appID, keyPEM, *installationID)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		client.SetAppAuth(app)
+	}
+
+	var prefix string
+	if *stripPrefix != "" {
+		prefix = strings.TrimSuffix(*stripPrefix, "/") + "/"
+	}
+	opts := &options{
+		outputDir:     *outputDir,
+		format:        *format,
+		counts:        *counts,
+		stdout:        *stdout,
+		nameTmpl:      nameTmpl,
+		maxFiles:      *maxFiles,
+		dryRun:        *dryRun,
+		alwaysWrite:   *alwaysWrite,
+		ghOutput:      ghOutput,
+		includes:      includes,
+		excludes:      excludes,
+		filterRegex:   pathRegex,
+		withPatch:     *withPatch,
+		maxPatchBytes: *maxPatchBytes,
+		since:         sinceTime,
+		cacheDir:      *cacheDir,
+		multiRepo:     len(repos) > 1,
+		skipDrafts:    *skipDrafts,
+		perPRDir:      *perPRDir,
+		repoDirs:      *repoDirs,
+		onlyAggregate: *onlyAggregate,
+		prDiff:        *prDiff,
+		skipCount:     *skipCount,
+		collapseDirs:  *collapse,
+		markBinary:    *markBinary,
+		escapeNames:   *flattenNewlines,
+		print0:        *print0,
+		shaSuffix:     *shaSuffix,
+		renameAsDel:   *renameAsDelete,
+		perCommit:     *perCommit,
+		graphql:       *graphql,
+		sink:          sink,
+
+		stripPrefix:    prefix,
+		keepUnprefixed: *keepUnprefixed,
+		checksum:       *checksum,
+		withURLs:       *withURLs,
+		mergeQueue:     *mergeQueue,
+		requireLabels:  parseLabels(*requireLabel),
+		skipLabels:     parseLabels(*skipLabel),
+		labelFold:      *labelIgnoreCase,
+		prTimeout:      *timeoutPerPR,
+	}
+	if *manifestPath != "" {
+		opts.manifest = &manifest{}
+	}
+	if *excludeGenerated {
+		opts.generated = &generatedCache{patterns: make(map[string][]generatedPattern)}
+	}
+	if *withBlame {
+		opts.blame = &blameCache{authors: make(map[string]string)}
+	}
+
+	repoOpts := make(map[string]*options, len(repos))
+	for _, repo := range repos {
+		if repoOpts[repo], err = repoOptions(opts, repo); err != nil {
+			logger.Fatalf("%v", err)
+		}
+	}
+
+	if *compare != "" {
+		entries, err := runCompare(ctx, client, repos[0], *compare, repoOpts[repos[0]])
+		if err != nil {
+			logger.Fatalf("Failed to compare %s: %v", *compare, err)
+		}
+		if matches := deletedMatches(entries, deletedPatterns); len(matches) > 0 {
+			logger.Fatalf("%s deletes files matching -fail-on-deleted: %s", *compare, strings.Join(matches, ", "))
+		}
+		writeManifest(opts, *manifestPath)
+		return
+	}
+
+	if *commit != "" {
+		entries, err := runCommit(ctx, client, repos[0], *commit, repoOpts[repos[0]])
+		if err != nil {
+			logger.Fatalf("Failed to list files in commit %s: %v", *commit, err)
+		}
+		if matches := deletedMatches(entries, deletedPatterns); len(matches) > 0 {
+			logger.Fatalf("%s deletes files matching -fail-on-deleted: %s", *commit, strings.Join(matches, ", "))
+		}
+		writeManifest(opts, *manifestPath)
+		return
+	}
+
+	if *diffPRs != "" {
+		if err := runDiffPRs(ctx, client, repos[0], diffA, diffB, *diffMode, repoOpts[repos[0]]); err != nil {
+			logger.Fatalf("%v", err)
+		}
+		writeManifest(opts, *manifestPath)
+		return
 	}
 
 	var prs []int
-	for _, p := range strings.Split(*pullRequests, ",") {
-		pr, err := strconv.Atoi(p)
+	switch {
+	case *state != "" || *query != "":
+	case *pullsFile != "":
+		f, openErr := os.Open(*pullsFile)
+		if openErr != nil {
+			logger.Fatalf("Failed to open pulls file: %v", openErr)
+		}
+		prs, err = parsePRList(f, *pullsFile)
+		f.Close()
+	case *pullRequests == "-":
+		prs, err = parsePRList(os.Stdin, "stdin")
+	default:
+		prs, err = parsePRList(strings.NewReader(*pullRequests), "-pulls")
+	}
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	var jobs []prJob
+	for _, repo := range repos {
+		if *query != "" {
+			numbers, err := prfiles.SearchPRs(ctx, client, *query+" repo:"+repo)
+			if err != nil {
+				logger.Fatalf("Failed to search pull requests: %v", err)
+			}
+			for _, pr := range numbers {
+				jobs = append(jobs, prJob{repo, pr})
+			}
+			continue
+		}
+		if *state == "" {
+			for _, pr := range prs {
+				jobs = append(jobs, prJob{repo, pr})
+			}
+			continue
+		}
+		pulls, err := prfiles.ListPRs(ctx, client, repo, *state)
 		if err != nil {
-			log.Fatalf("[ERROR] Invalid pull request number: %s", p)
+			logger.Fatalf("Failed to list pull requests in %s: %v", repo, err)
+		}
+		if len(pulls) == 0 {
+			logger.Infof("No %s pull requests found in %s", *state, repo)
+		}
+		for _, pull := range pulls {
+			if !sinceTime.IsZero() && pull.UpdatedAt.Before(sinceTime) {
+				logger.Debugf("Skipping PR %d: last updated %s, before -since", pull.Number, pull.UpdatedAt.Format(time.RFC3339))
+				continue
+			}
+			if *skipDrafts && pull.Draft {
+				logger.Debugf("Skipping PR %d: it is a draft", pull.Number)
+				continue
+			}
+			if reason := labelMismatch(opts, pull.Labels); reason != "" {
+				logger.Debugf("Skipping PR %d: %s", pull.Number, reason)
+				continue
+			}
+			jobs = append(jobs, prJob{repo, pull.Number})
 		}
-		prs = append(prs, pr)
 	}
-	log.Printf("[DEBUG] Repository: %s, Pull Requests: %v", *repo, prs)
+	if len(jobs) == 0 {
+		logger.Infof("No matching pull requests to process")
+		return
+	}
+	logger.Debugf("Repositories: %v, Pull Requests: %v, Token: %s (from %s)", repos, jobs, redactToken(*token), tokenSource)
 
 	var wg sync.WaitGroup
-	results := make(chan map[string][]string, len(prs))
+	results := make(chan *prResult, len(jobs))
 
-	for _, pr := range prs {
+	sem := make(chan struct{}, max(*concurrency, 1))
+	for _, job := range jobs {
 		wg.Add(1)
-		go processPR(*repo, pr, *token, *outputDir, &wg, results)
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			processPR(ctx, client, job.repo, job.pr, repoOpts[job.repo], &wg, results)
+		}()
 	}
 
 	go func() {
@@ -209,24 +2454,190 @@ func main() {
 		close(results)
 	}()
 
-	var allFiles, allChangedFiles, allDeletedFiles []string
-	for filesMap := range results {
-		if filesMap != nil {
-			allFiles = append(allFiles, filesMap["all"]...)
-			allChangedFiles = append(allChangedFiles, filesMap["chg"]...)
-			allDeletedFiles = append(allDeletedFiles, filesMap["del"]...)
+	allRenamedFiles := make(map[string][]string)
+	allEntries := make(map[string]map[int][]prfiles.FileChange)
+	ndjson := json.NewEncoder(os.Stdout)
+	for _, repo := range repos {
+		allEntries[repo] = make(map[int][]prfiles.FileChange)
+	}
+	var summary runSummary
+	succeeded, failed, skipped, policyFailed := 0, 0, 0, 0
+	completed := 0
+	for result := range results {
+		completed++
+		if len(jobs) > 1 {
+			logger.Infof("Completed %d/%d pull requests", completed, len(jobs))
+		}
+		if result == nil {
+			failed++
+			if *strict {
+				logger.Errorf("Aborting after the first failed pull request (-strict)")
+				cancel()
+			}
+			continue
+		}
+		if result.skipped {
+			skipped++
+			continue
+		}
+		if result.incomplete {
+			failed++
+		} else {
+			succeeded++
+		}
+
+		var repoName string
+		if opts.multiRepo {
+			repoName = result.repo
+		}
+		label := prLabel(repoName, result.pr)
+		if matches := deletedMatches(result.entries, deletedPatterns); len(matches) > 0 {
+			logger.ForPR(result.pr).Errorf("%s deletes files matching -fail-on-deleted: %s", label, strings.Join(matches, ", "))
+			policyFailed++
+		}
+
+		if *format == "ndjson" {
+			if err := writeNDJSON(ndjson, repoName, result); err != nil {
+				logger.Fatalf("Failed to write NDJSON to stdout: %v", err)
+			}
+			summary.add(repoName, result)
+			if *statsPath != "" {
+				allEntries[result.repo][result.pr] = result.entries
+			}
+			continue
+		}
+		if *stdout && *format == "text" {
+			if !*print0 {
+				fmt.Printf("# %s\n", label)
+			}
+			printFiles(opts, result.files["all"])
+		}
+		allRenamedFiles[result.repo] = append(allRenamedFiles[result.repo], result.files["ren"]...)
+		summary.add(repoName, result)
+		allEntries[result.repo][result.pr] = result.entries
+	}
+
+	if err := ctx.Err(); err != nil {
+		logger.Fatalf("Run aborted before all pull requests completed (%d succeeded, %d failed): %v", succeeded, failed, err)
+	}
+
+	switch {
+	case ghOutput != "":
+		aggregates := statusAggregates(mergeStatuses(allEntries[repos[0]]), *withStatus, *counts, *renameAsDelete)
+		collapseDirs(aggregates, *collapse)
+		aggregates["ren"] = compactSorted(allRenamedFiles[repos[0]])
+		if err := writeGitHubOutput(opts, aggregates); err != nil {
+			logger.Fatalf("Failed to write step outputs: %v", err)
+		}
+		logger.Infof("Step outputs appended to %s", ghOutput)
+	case *stdout:
+		switch *format {
+		case "json":
+			var doc any = allEntries
+			if !opts.multiRepo {
+				doc = allEntries[repos[0]]
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(doc); err != nil {
+				logger.Fatalf("Failed to write JSON to stdout: %v", err)
+			}
+		case "csv":
+			if err := writeCSV(os.Stdout, opts, repos, allEntries); err != nil {
+				logger.Fatalf("Failed to write CSV to stdout: %v", err)
+			}
+		}
+	case *format == "csv":
+		if err := writeOutputCSV(opts, filepath.Join(*outputDir, "all.csv"), repos, allEntries); err != nil {
+			logger.Fatalf("Failed to create all.csv: %v", err)
+		}
+		rows := 0
+		for _, repo := range repos {
+			for _, entries := range allEntries[repo] {
+				rows += len(entries)
+			}
+		}
+		recordOutput(opts, "", 0, "csv", filepath.Join(*outputDir, "all.csv"), rows)
+		logger.Infof("All files saved to all.csv")
+	case *noAggregate && (*format == "json" || *format == "text"):
+		logger.Debugf("Skipping aggregate files (-no-aggregate)")
+	case *format == "json":
+		for _, repo := range repos {
+			filePath := filepath.Join(repoOpts[repo].outputDir, fileID(opts, repo, "all")+".json")
+			if err := writeOutputJSON(opts, filePath, allEntries[repo]); err != nil {
+				logger.Fatalf("Failed to create %s: %v", filePath, err)
+			}
+			files := 0
+			for _, entries := range allEntries[repo] {
+				files += len(entries)
+			}
+			recordOutput(opts, repo, 0, "json", filePath, files)
+		}
+		logger.Infof("Aggregate files saved to %s", *outputDir)
+	default:
+		for _, repo := range repos {
+			aggregates := statusAggregates(mergeStatuses(allEntries[repo]), *withStatus, *counts, *renameAsDelete)
+			collapseDirs(aggregates, *collapse)
+			aggregates["ren"] = compactSorted(allRenamedFiles[repo])
+			for name, content := range aggregates {
+				sort.Strings(content)
+				filePath, err := outputPath(repoOpts[repo], fileID(opts, repo, "all"), name)
+				if err != nil {
+					logger.Fatalf("Failed to build output path: %v", err)
+				}
+				if *appendAggregates {
+					if content, err = mergeExisting(opts, filePath, content); err != nil {
+						logger.Fatalf("Failed to read %s for -append: %v", filePath, err)
+					}
+				}
+				if err := writeOutputFile(opts, filePath, content); err != nil {
+					logger.Fatalf("Failed to create %s: %v", filePath, err)
+				}
+				recordOutput(opts, repo, 0, name, filePath, len(content))
+			}
+		}
+		logger.Infof("Aggregate files saved to %s", *outputDir)
+	}
+
+	if *checksum && ghOutput == "" && !*stdout && !*noAggregate {
+		for _, repo := range repos {
+			merged := mergeStatuses(allEntries[repo])
+			entries := make([]prfiles.FileChange, 0, len(merged))
+			for _, entry := range merged {
+				entries = append(entries, entry)
+			}
+			filePath := filepath.Join(repoOpts[repo].outputDir, fileID(opts, repo, "all")+".sha256")
+			if err := writeChecksum(opts, repo, 0, filePath, entries); err != nil {
+				logger.Fatalf("Failed to create %s: %v", filePath, err)
+			}
 		}
 	}
 
-	for name, content := range map[string][]string{
-		"all": allFiles,
-		"chg": allChangedFiles,
-		"del": allDeletedFiles,
-	} {
-		if err := writeFile(filepath.Join(*outputDir, fmt.Sprintf("all_%s.txt", name)), content); err != nil {
-			log.Fatalf("[ERROR] Failed to create all_%s.txt: %v", name, err)
+	if *summaryPath != "" {
+		if err := writeSummary(opts, *summaryPath, &summary); err != nil {
+			logger.Fatalf("Failed to write summary: %v", err)
 		}
 	}
 
-	log.Println("[INFO] All files saved to all.txt, all_chg.txt, and all_del.txt")
+	if *statsPath != "" {
+		var stats []extensionStats
+		for _, repo := range repos {
+			stats = addExtensionStats(stats, mergeStatuses(allEntries[repo]))
+		}
+		if err := writeStats(opts, *statsPath, stats); err != nil {
+			logger.Fatalf("Failed to write stats: %v", err)
+		}
+	}
+
+	writeManifest(opts, *manifestPath)
+
+	logger.Infof("Processed %d pull requests: %d succeeded, %d failed, %d skipped", len(jobs), succeeded, failed, skipped)
+	// With several tokens, the last response seen may belong to any of
+	// them, so no single remaining count describes the run.
+	if limit, ok := client.RateLimit(); ok && len(tokens) <= 1 {
+		logger.Infof("Rate limit: %d/%d remaining, resets at %s", limit.Remaining, limit.Limit, limit.Reset.Format(time.RFC3339))
+	}
+	if failed > 0 || policyFailed > 0 {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,134 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the minimum severity of messages that are written.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+var (
+	current    atomic.Int32
+	jsonFormat atomic.Bool
+	writeMu    sync.Mutex
+)
+
+func init() {
+	current.Store(int32(LevelInfo))
+}
+
+// ParseLevel converts a level name such as "debug" or "warn" into a Level.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) || (strings.EqualFold(name, "warning") && level == LevelWarn) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level: %s", name)
+}
+
+// SetLevel sets the minimum level of messages that are written.
+func SetLevel(level Level) {
+	current.Store(int32(level))
+}
+
+// SetFormat selects the output format: "text" for human-readable lines or
+// "json" for one JSON object per line.
+func SetFormat(name string) error {
+	switch name {
+	case "text":
+		jsonFormat.Store(false)
+	case "json":
+		jsonFormat.Store(true)
+	default:
+		return fmt.Errorf("invalid log format: %s", name)
+	}
+	return nil
+}
+
+// Enabled reports whether messages at level are written.
+func Enabled(level Level) bool {
+	return level >= Level(current.Load())
+}
+
+type jsonLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	PR    int    `json:"pr,omitempty"`
+}
+
+func write(level Level, pr int, format string, args ...any) {
+	if !jsonFormat.Load() {
+		log.Printf("["+levelNames[level]+"] "+format, args...)
+		return
+	}
+
+	line, err := json.Marshal(jsonLine{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Level: strings.ToLower(levelNames[level]),
+		Msg:   fmt.Sprintf(format, args...),
+		PR:    pr,
+	})
+	if err != nil {
+		return
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	log.Writer().Write(append(line, '\n'))
+}
+
+func logf(level Level, pr int, format string, args ...any) {
+	if !Enabled(level) {
+		return
+	}
+	write(level, pr, format, args...)
+}
+
+func Debugf(format string, args ...any) { logf(LevelDebug, 0, format, args...) }
+func Infof(format string, args ...any)  { logf(LevelInfo, 0, format, args...) }
+func Warnf(format string, args ...any)  { logf(LevelWarn, 0, format, args...) }
+func Errorf(format string, args ...any) { logf(LevelError, 0, format, args...) }
+
+// Fatalf logs an error regardless of the current level and exits with status 1.
+func Fatalf(format string, args ...any) {
+	write(LevelError, 0, format, args...)
+	os.Exit(1)
+}
+
+// PRLogger logs messages about a single pull request. In JSON format its
+// lines carry the pull request number in the pr field.
+type PRLogger struct {
+	pr int
+}
+
+// ForPR returns a logger for messages about pull request pr.
+func ForPR(pr int) PRLogger {
+	return PRLogger{pr: pr}
+}
+
+func (l PRLogger) Debugf(format string, args ...any) { logf(LevelDebug, l.pr, format, args...) }
+func (l PRLogger) Infof(format string, args ...any)  { logf(LevelInfo, l.pr, format, args...) }
+func (l PRLogger) Warnf(format string, args ...any)  { logf(LevelWarn, l.pr, format, args...) }
+func (l PRLogger) Errorf(format string, args ...any) { logf(LevelError, l.pr, format, args...) }
@@ -0,0 +1,141 @@
+package prfiles
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const appJWTLifetime = 9 * time.Minute
+
+// AppAuth authenticates as a GitHub App installation. Installation tokens are
+// cached and only exchanged again shortly before they expire.
+type AppAuth struct {
+	appID          string
+	installationID int64
+	key            *rsa.PrivateKey
+	client         *Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewAppAuth returns an AppAuth for the given app ID, PEM-encoded private key,
+// and installation ID.
+func NewAppAuth(appID string, privateKeyPEM []byte, installationID int64) (*AppAuth, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode app private key: no PEM data found")
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse app private key: %w", err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("failed to parse app private key: not an RSA key")
+		}
+		key = rsaKey
+	}
+
+	return &AppAuth{appID: appID, installationID: installationID, key: key}, nil
+}
+
+func (a *AppAuth) signJWT(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign app JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Header returns the installation token as a bearer credential, exchanging a
+// new one if needed. The AppAuth must be attached with Client.SetAppAuth.
+func (a *AppAuth) Header(ctx context.Context) (string, error) {
+	if a.client == nil {
+		return "", fmt.Errorf("app authentication is not attached to a client")
+	}
+	token, err := a.installationToken(ctx, a.client)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+func (a *AppAuth) installationToken(ctx context.Context, client *Client) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Until(a.expiresAt) > time.Minute {
+		return a.token, nil
+	}
+
+	jwt, err := a.signJWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	url := client.apiURL + "/app/installations/" + strconv.FormatInt(a.installationID, 10) + "/access_tokens"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, value := range githubHeaders("Bearer "+jwt, client.userAgent, client.apiVersion) {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request installation token: %w", err)
+	}
+	if err := decompressBody(resp); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("failed to request installation token: unexpected response status: %s", resp.Status)
+	}
+
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to unmarshal installation token: %w", err)
+	}
+
+	a.token, a.expiresAt = body.Token, body.ExpiresAt
+	return a.token, nil
+}
@@ -0,0 +1,75 @@
+package prfiles
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Authenticator supplies the Authorization header value for API requests.
+type Authenticator interface {
+	Header(ctx context.Context) (string, error)
+}
+
+// StaticToken authenticates with a fixed token, such as a personal access
+// token or an OAuth token.
+type StaticToken string
+
+// Header returns the token as a bearer credential.
+func (t StaticToken) Header(ctx context.Context) (string, error) {
+	return "Bearer " + string(t), nil
+}
+
+// TokenPool spreads requests across several tokens in turn. A token that
+// runs out of its rate limit is skipped until its quota resets, so a run
+// only waits once every token is exhausted.
+type TokenPool struct {
+	mu     sync.Mutex
+	tokens []string
+	resets []time.Time
+	next   int
+}
+
+// NewTokenPool returns a TokenPool over tokens, which must not be empty.
+func NewTokenPool(tokens []string) *TokenPool {
+	return &TokenPool{tokens: tokens, resets: make([]time.Time, len(tokens))}
+}
+
+// Header returns the next token whose quota is not exhausted. If all are,
+// it returns the one that resets first.
+func (p *TokenPool) Header(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	earliest := p.next
+	for i := range p.tokens {
+		idx := (p.next + i) % len(p.tokens)
+		if !now.Before(p.resets[idx]) {
+			p.next = (idx + 1) % len(p.tokens)
+			return "Bearer " + p.tokens[idx], nil
+		}
+		if p.resets[idx].Before(p.resets[earliest]) {
+			earliest = idx
+		}
+	}
+	return "Bearer " + p.tokens[earliest], nil
+}
+
+// exhausted marks the token behind authorization as rate limited until
+// reset. It reports whether another token can be used right away.
+func (p *TokenPool) exhausted(authorization string, reset time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	available := false
+	for i, token := range p.tokens {
+		if "Bearer "+token == authorization {
+			p.resets[i] = reset
+		} else if !now.Before(p.resets[i]) {
+			available = true
+		}
+	}
+	return available
+}
@@ -0,0 +1,113 @@
+package prfiles
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenPoolRotation(t *testing.T) {
+	pool := NewTokenPool([]string{"a", "b", "c"})
+	var got []string
+	for range 4 {
+		header, err := pool.Header(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, header)
+	}
+	if want := "Bearer a,Bearer b,Bearer c,Bearer a"; strings.Join(got, ",") != want {
+		t.Errorf("headers = %s, want %s", strings.Join(got, ","), want)
+	}
+}
+
+func TestTokenPoolExhausted(t *testing.T) {
+	pool := NewTokenPool([]string{"a", "b"})
+	now := time.Now()
+	if !pool.exhausted("Bearer a", now.Add(time.Hour)) {
+		t.Fatal("exhausted(a) = false, want b to be available")
+	}
+	for range 2 {
+		if header, _ := pool.Header(context.Background()); header != "Bearer b" {
+			t.Errorf("Header() = %q, want Bearer b while a is exhausted", header)
+		}
+	}
+	if pool.exhausted("Bearer b", now.Add(time.Minute)) {
+		t.Fatal("exhausted(b) = true, want no token available")
+	}
+	if header, _ := pool.Header(context.Background()); header != "Bearer b" {
+		t.Errorf("Header() = %q, want Bearer b, which resets first", header)
+	}
+}
+
+// rateLimitedFor returns a handler that answers 403 with an exhausted quota
+// resetting at reset for the tokens in limited, and a pull request otherwise.
+func rateLimitedFor(reset time.Time, limited ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for _, l := range limited {
+			if token == l || l == "*" {
+				w.Header().Set("X-RateLimit-Limit", "5000")
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"message":"API rate limit exceeded"}`)
+				return
+			}
+		}
+		fmt.Fprint(w, `{"number":1,"changed_files":2}`)
+	}
+}
+
+func TestTokenPoolSwitchesOnRateLimit(t *testing.T) {
+	client, requests := newTestClient(t, rateLimitedFor(time.Now().Add(time.Hour), "a"))
+	client.SetAuthenticator(NewTokenPool([]string{"a", "b"}))
+
+	for range 2 {
+		if _, err := GetPR(context.Background(), client, "o/r", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request is retried with b, and the second goes straight to
+	// b because a stays exhausted until its reset.
+	if n := requests.Load(); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+}
+
+func TestTokenPoolStaleResetWaits(t *testing.T) {
+	client, requests := newTestClient(t, rateLimitedFor(time.Now().Add(-time.Hour), "*"))
+	client.SetAuthenticator(NewTokenPool([]string{"a", "b"}))
+	client.maxWait = minRateLimitWait / 2
+
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if err == nil || !strings.Contains(err.Error(), "exceeds max wait") {
+		t.Fatalf("err = %v, want a max wait error", err)
+	}
+	// a and b are each tried once; neither can be switched back to before
+	// the minimum wait has passed.
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+}
+
+func TestTokenPoolRetryLimit(t *testing.T) {
+	tokens := make([]string, 2*maxRateLimitRetries)
+	for i := range tokens {
+		tokens[i] = fmt.Sprint("t", i)
+	}
+	client, requests := newTestClient(t, rateLimitedFor(time.Now().Add(time.Hour), "*"))
+	client.SetAuthenticator(NewTokenPool(tokens))
+
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if err == nil || !strings.Contains(err.Error(), "gave up after") {
+		t.Fatalf("err = %v, want a retry limit error", err)
+	}
+	if n := requests.Load(); n != maxRateLimitRetries+1 {
+		t.Errorf("requests = %d, want %d", n, maxRateLimitRetries+1)
+	}
+}
@@ -0,0 +1,491 @@
+package prfiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.dmoruzzi.com/github-pr-files/pkg/logger"
+)
+
+const (
+	DefaultAPIURL         = "https://api.github.com"
+	acceptHeader          = "application/vnd.github+json"
+	userAgentHeader       = "dmoruzzi/github-pr-info@0.0.0"
+	DefaultAPIVersion     = "2022-11-28"
+	MaxPerPage            = 100
+	secondaryLimitDelay   = time.Minute
+	minRateLimitWait      = time.Second
+	maxRateLimitRetries   = 10
+	DefaultRequestTimeout = 30 * time.Second
+)
+
+// Client performs authenticated requests against the GitHub REST API,
+// waiting out rate limits and retrying transient failures.
+type Client struct {
+	httpClient *http.Client
+	apiURL     string
+	auth       Authenticator
+	maxWait    time.Duration
+	retry      RetryPolicy
+	secondary  bool
+	userAgent  string
+	apiVersion string
+	perPage    int
+
+	mu        sync.Mutex
+	rateLimit RateLimit
+}
+
+// RateLimit is the REST API quota reported by the X-RateLimit-* response
+// headers.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// NewClient returns a Client for the API rooted at apiURL. maxWait bounds how
+// long a single request may block on rate limits, and retries is the maximum
+// number of attempts for network errors and 5xx responses, with the backoff
+// of DefaultRetryPolicy (see SetRetryPolicy).
+func NewClient(apiURL string, token string, maxWait time.Duration, retries int) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+	retry := DefaultRetryPolicy()
+	retry.MaxAttempts = retries
+
+	return &Client{
+		httpClient: &http.Client{Transport: transport, Timeout: DefaultRequestTimeout},
+		apiURL:     strings.TrimRight(apiURL, "/"),
+		auth:       StaticToken(token),
+		maxWait:    maxWait,
+		retry:      retry,
+		secondary:  true,
+		userAgent:  userAgentHeader,
+		apiVersion: DefaultAPIVersion,
+		perPage:    MaxPerPage,
+	}
+}
+
+// SetHTTPClient replaces the HTTP client used for requests, for example to
+// route them through a custom transport or an httptest.Server's client. The
+// client is copied, and the copy's Timeout is set to the request timeout
+// (DefaultRequestTimeout unless changed with SetRequestTimeout, before or
+// after this call); httpClient itself is not modified.
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	timeout := c.httpClient.Timeout
+	copied := *httpClient
+	copied.Timeout = timeout
+	c.httpClient = &copied
+}
+
+// SetRequestTimeout bounds each HTTP request, including reading the response
+// body. A request that times out is retried like other network errors. Zero
+// means no timeout.
+func (c *Client) SetRequestTimeout(d time.Duration) {
+	copied := *c.httpClient
+	copied.Timeout = d
+	c.httpClient = &copied
+}
+
+// SetRetrySecondaryLimit controls whether requests blocked by GitHub's
+// secondary rate limit are retried after a wait. It is enabled by default;
+// when disabled, such requests fail immediately.
+func (c *Client) SetRetrySecondaryLimit(retry bool) {
+	c.secondary = retry
+}
+
+// SetRetryPolicy replaces the policy for retrying network errors and 5xx
+// responses, including the number of attempts given to NewClient.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
+}
+
+// SetUserAgent overrides the default User-Agent header sent with requests.
+func (c *Client) SetUserAgent(userAgent string) {
+	c.userAgent = userAgent
+}
+
+// SetAPIVersion overrides the X-GitHub-Api-Version header sent with
+// requests. An empty version omits the header, for servers that reject it.
+func (c *Client) SetAPIVersion(version string) {
+	c.apiVersion = version
+}
+
+// SetPerPage sets the page size requested from paginated endpoints, clamped to
+// 1..MaxPerPage. Pagination always follows the Link header, so pages smaller
+// than requested are handled either way.
+func (c *Client) SetPerPage(n int) {
+	c.perPage = min(max(n, 1), MaxPerPage)
+}
+
+// SetAuthenticator replaces the static token the client was created with.
+func (c *Client) SetAuthenticator(auth Authenticator) {
+	c.auth = auth
+}
+
+// SetAppAuth makes the client authenticate as a GitHub App installation
+// instead of using its static token. Installation tokens are exchanged
+// through c.
+func (c *Client) SetAppAuth(app *AppAuth) {
+	app.client = c
+	c.SetAuthenticator(app)
+}
+
+// RateLimit returns the most recent rate limit status seen in a response. The
+// boolean is false if no response carried rate limit headers. With a
+// TokenPool, the status may belong to any of its tokens.
+func (c *Client) RateLimit() (RateLimit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimit, c.rateLimit.Limit > 0
+}
+
+// recordRateLimit keeps the rate limit status from header. With concurrent
+// requests, responses can arrive out of order, so the lowest remaining count
+// within the latest reset window wins.
+func (c *Client) recordRateLimit(header http.Header) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	current := RateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rateLimit.Limit == 0 || current.Reset.After(c.rateLimit.Reset) ||
+		(current.Reset.Equal(c.rateLimit.Reset) && current.Remaining < c.rateLimit.Remaining) {
+		c.rateLimit = current
+	}
+}
+
+func githubHeaders(authorization string, userAgent string, apiVersion string) map[string]string {
+	headers := map[string]string{
+		"Accept":          acceptHeader,
+		"Accept-Encoding": "gzip",
+		"Authorization":   authorization,
+		"User-Agent":      userAgent,
+	}
+	if apiVersion != "" {
+		headers["X-GitHub-Api-Version"] = apiVersion
+	}
+	return headers
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipBody decompresses a gzip-encoded response body, tracking how many
+// compressed bytes came over the wire.
+type gzipBody struct {
+	*gzip.Reader
+	wire *countingReader
+	body io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// decompressBody wraps resp.Body in a gzip reader if the response is gzip
+// encoded. Because Accept-Encoding is set explicitly, the transport does not
+// decompress responses itself.
+func decompressBody(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	wire := &countingReader{r: resp.Body}
+	gz, err := gzip.NewReader(wire)
+	if err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("failed to decompress response: %w", err)
+	}
+	resp.Body = &gzipBody{Reader: gz, wire: wire, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// secondaryRateLimited reports whether resp is a 403 or 429 caused by
+// GitHub's secondary (abuse detection) rate limit, which is identified by its
+// message rather than by the X-RateLimit headers. The body is buffered so it
+// can still be read afterwards.
+func secondaryRateLimited(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	message := strings.ToLower(string(body))
+	return strings.Contains(message, "secondary rate limit") || strings.Contains(message, "abuse detection")
+}
+
+// secondaryLimitWait returns how long to wait after a secondary rate limit:
+// the Retry-After header if positive, otherwise the minute GitHub recommends.
+func secondaryLimitWait(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return secondaryLimitDelay
+}
+
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return max(time.Duration(seconds)*time.Second, minRateLimitWait), true
+		}
+	}
+
+	// A reset time in the past means the clocks disagree or the header is
+	// stale; waiting at least minRateLimitWait keeps the retry from spinning.
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(time.Until(time.Unix(reset, 0))+time.Second, minRateLimitWait), true
+		}
+	}
+
+	return 0, false
+}
+
+func nextPageURL(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		target, params, found := strings.Cut(strings.TrimSpace(link), ";")
+		target = strings.TrimSpace(target)
+		if !found || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(target, "<>")
+			}
+		}
+	}
+	return ""
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ErrNotFound matches, with errors.Is, the errors returned for API responses
+// with status 404 Not Found.
+var ErrNotFound = errors.New("not found")
+
+// statusError is an unexpected API response.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func (e *statusError) Is(target error) bool {
+	return target == ErrNotFound && e.code == http.StatusNotFound
+}
+
+func responseError(resp *http.Response) error {
+	var body struct {
+		Message          string `json:"message"`
+		DocumentationURL string `json:"documentation_url"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	json.Unmarshal(data, &body)
+
+	msg := fmt.Sprintf("unexpected response status: %s", resp.Status)
+	if body.Message != "" {
+		msg += ": " + body.Message
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden && strings.Contains(body.Message, "Resource not accessible by personal access token"):
+		msg += " (the fine-grained token is not authorized for this repository; add the repository to the token's repository access and grant it read access to pull requests and contents)"
+	case resp.StatusCode == http.StatusForbidden && strings.Contains(body.Message, "Resource not accessible by integration"):
+		msg += " (the GitHub App installation cannot access this repository; add the repository to the installation and grant it read access to pull requests and contents)"
+	case strings.Contains(strings.ToLower(body.Message), "secondary rate limit"):
+		msg += " (GitHub's secondary rate limit; send fewer concurrent requests or retry later)"
+	case resp.StatusCode == http.StatusNotFound:
+		msg += " (GitHub returns 404 for private repositories the token cannot access; check the repository name and that the token has repository read access)"
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+		msg += " (check the token's scopes, and authorize it for SAML SSO if the organization requires it)"
+	}
+	if body.DocumentationURL != "" {
+		msg += "; see " + body.DocumentationURL
+	}
+	return &statusError{resp.StatusCode, msg}
+}
+
+func doGitHubRequest(ctx context.Context, client *Client, url string) ([]byte, http.Header, error) {
+	return doGitHubRequestBody(ctx, client, "GET", url, nil)
+}
+
+// doGitHubRequestBody is doGitHubRequest for requests that send a payload,
+// which is resent on every retry.
+func doGitHubRequestBody(ctx context.Context, client *Client, method string, url string, payload []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	authorization, err := client.auth.Header(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key, value := range githubHeaders(authorization, client.userAgent, client.apiVersion) {
+		req.Header.Set(key, value)
+	}
+
+	retries := max(client.retry.MaxAttempts, 1)
+	var waited time.Duration
+	var limited int
+	for attempt := 1; ; attempt++ {
+		if payload != nil {
+			req.Body = io.NopCloser(bytes.NewReader(payload))
+			req.ContentLength = int64(len(payload))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := client.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, fmt.Errorf("request cancelled: %w", ctx.Err())
+			}
+			if attempt < retries {
+				delay := client.retry.Delay(attempt)
+				logger.Warnf("Request to %s failed (attempt %d/%d), retrying in %s: %v", url, attempt, retries, delay.Round(time.Millisecond), err)
+				if err := sleepContext(ctx, delay); err != nil {
+					return nil, nil, fmt.Errorf("request cancelled: %w", err)
+				}
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to execute request after %d attempt(s): %w", attempt, err)
+		}
+		if err := decompressBody(resp); err != nil {
+			return nil, nil, err
+		}
+		client.recordRateLimit(resp.Header)
+
+		if secondaryRateLimited(resp) {
+			if !client.secondary {
+				defer resp.Body.Close()
+				return nil, nil, responseError(resp)
+			}
+			resp.Body.Close()
+			if limited++; limited > maxRateLimitRetries {
+				return nil, nil, fmt.Errorf("secondary rate limit: %s (gave up after %d retries)", resp.Status, maxRateLimitRetries)
+			}
+			// Jitter spreads out the retries of concurrent requests that
+			// hit the limit together.
+			wait := secondaryLimitWait(resp)
+			wait += rand.N(wait/4 + 1)
+			if waited+wait > client.maxWait {
+				return nil, nil, fmt.Errorf("secondary rate limit: %s (retry in %s exceeds max wait %s)", resp.Status, wait.Round(time.Second), client.maxWait)
+			}
+			logger.Warnf("Secondary rate limit hit (%s), waiting %s before retrying %s", resp.Status, wait.Round(time.Second), url)
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, nil, fmt.Errorf("request cancelled: %w", err)
+			}
+			waited += wait
+			attempt--
+			continue
+		}
+
+		if wait, ok := rateLimitWait(resp); ok {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if limited++; limited > maxRateLimitRetries {
+				return nil, nil, fmt.Errorf("rate limited: %s (gave up after %d retries)", resp.Status, maxRateLimitRetries)
+			}
+			if pool, ok := client.auth.(*TokenPool); ok && pool.exhausted(authorization, time.Now().Add(wait)) {
+				if authorization, err = pool.Header(ctx); err != nil {
+					return nil, nil, err
+				}
+				req.Header.Set("Authorization", authorization)
+				logger.Warnf("Rate limited (%s), switching to the next token for %s", resp.Status, url)
+				attempt--
+				continue
+			}
+			if waited+wait > client.maxWait {
+				return nil, nil, fmt.Errorf("rate limited: %s (retry in %s exceeds max wait %s)", resp.Status, wait.Round(time.Second), client.maxWait)
+			}
+			logger.Warnf("Rate limited (%s), waiting %s before retrying %s", resp.Status, wait.Round(time.Second), url)
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, nil, fmt.Errorf("request cancelled: %w", err)
+			}
+			waited += wait
+			attempt--
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if attempt < retries {
+				delay := client.retry.Delay(attempt)
+				logger.Warnf("Request to %s returned %s (attempt %d/%d), retrying in %s", url, resp.Status, attempt, retries, delay.Round(time.Millisecond))
+				if err := sleepContext(ctx, delay); err != nil {
+					return nil, nil, fmt.Errorf("request cancelled: %w", err)
+				}
+				continue
+			}
+			return nil, nil, fmt.Errorf("unexpected response status after %d attempt(s): %s", attempt, resp.Status)
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, responseError(resp)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if gz, ok := resp.Body.(*gzipBody); ok && err == nil {
+			logger.Debugf("Received %d bytes (%d gzip-compressed) from %s", len(body), gz.wire.n, url)
+		}
+		return body, resp.Header, err
+	}
+}
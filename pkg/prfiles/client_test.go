@@ -0,0 +1,417 @@
+package prfiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a stub API server running handler, with
+// fast retries, and a counter of the requests the server received.
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := NewClient(srv.URL, "test-token", time.Minute, 3)
+	client.SetHTTPClient(srv.Client())
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	return client, &requests
+}
+
+func TestFilesInPRPagination(t *testing.T) {
+	var serverURL string
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("X-GitHub-Api-Version"); got != DefaultAPIVersion {
+			t.Errorf("X-GitHub-Api-Version = %q", got)
+		}
+		page := r.URL.Query().Get("page")
+		switch page {
+		case "", "1":
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next", <%s%s?page=3>; rel="last"`, serverURL, r.URL.Path, serverURL, r.URL.Path))
+			fmt.Fprint(w, `[{"filename":"a.go","status":"modified"},{"filename":"b.go","status":"added"}]`)
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=3>; rel="next"`, serverURL, r.URL.Path))
+			fmt.Fprint(w, `[{"filename":"c.go","status":"removed"}]`)
+		case "3":
+			fmt.Fprint(w, `[{"filename":"d.go","status":"renamed","previous_filename":"old/d.go"}]`)
+		}
+	})
+	serverURL = client.apiURL
+
+	changes, err := FilesInPR(context.Background(), client, "o/r", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, change := range changes {
+		names = append(names, change.Filename)
+	}
+	if got := strings.Join(names, ","); got != "a.go,b.go,c.go,d.go" {
+		t.Errorf("files = %s", got)
+	}
+	if changes[3].PreviousFilename != "old/d.go" {
+		t.Errorf("PreviousFilename = %q", changes[3].PreviousFilename)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	var limited atomic.Bool
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if !limited.Swap(true) {
+			w.Header().Set("Retry-After", "0")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message":"API rate limit exceeded"}`)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Reset", "2000000000")
+		fmt.Fprint(w, `{"number":1,"changed_files":2}`)
+	})
+
+	pull, err := GetPR(context.Background(), client, "o/r", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pull.ChangedFiles != 2 {
+		t.Errorf("ChangedFiles = %d, want 2", pull.ChangedFiles)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+	if limit, ok := client.RateLimit(); !ok || limit.Remaining != 4999 {
+		t.Errorf("RateLimit() = %+v, %v", limit, ok)
+	}
+}
+
+func TestRateLimitExceedsMaxWait(t *testing.T) {
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if err == nil || !strings.Contains(err.Error(), "exceeds max wait") {
+		t.Fatalf("err = %v, want a max wait error", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestRateLimitStaleReset(t *testing.T) {
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"API rate limit exceeded"}`)
+	})
+	client.maxWait = 3 * minRateLimitWait / 2
+
+	start := time.Now()
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if err == nil || !strings.Contains(err.Error(), "exceeds max wait") {
+		t.Fatalf("err = %v, want a max wait error", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+	if elapsed := time.Since(start); elapsed < minRateLimitWait {
+		t.Errorf("elapsed = %s, want at least %s", elapsed, minRateLimitWait)
+	}
+}
+
+func TestSecondaryRateLimitDisabled(t *testing.T) {
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"You have exceeded a secondary rate limit."}`)
+	})
+	client.SetRetrySecondaryLimit(false)
+
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if err == nil || !strings.Contains(err.Error(), "secondary rate limit") {
+		t.Fatalf("err = %v, want a secondary rate limit error", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestSecondaryRateLimitRetryAfterZero(t *testing.T) {
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"You have exceeded a secondary rate limit."}`)
+	})
+	client.maxWait = 30 * time.Second
+
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if err == nil || !strings.Contains(err.Error(), "exceeds max wait") {
+		t.Fatalf("err = %v, want a max wait error", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int32
+		attempts     int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{"recovers", 2, 3, false, 3},
+		{"gives up", 5, 2, true, 2},
+		{"no retries", 1, 1, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failed atomic.Int32
+			client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if failed.Add(1) <= tt.failures {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				fmt.Fprint(w, `{"number":1}`)
+			})
+			client.SetRetryPolicy(RetryPolicy{MaxAttempts: tt.attempts, BaseDelay: time.Millisecond})
+
+			_, err := GetPR(context.Background(), client, "o/r", 1)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, text string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFilesInPRGzip(t *testing.T) {
+	body := gzipped(t, `[{"filename":"a.go","status":"modified"},{"filename":"b.go","status":"added"}]`)
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+			t.Errorf("Accept-Encoding = %q", got)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	})
+
+	changes, err := FilesInPR(context.Background(), client, "o/r", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Filename != "a.go" || changes[1].Status != "added" {
+		t.Errorf("changes = %+v", changes)
+	}
+}
+
+func TestCorruptGzip(t *testing.T) {
+	valid := gzipped(t, `{"number":1,"changed_files":2}`)
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"not gzip", []byte(`{"number":1}`)},
+		{"truncated", valid[:len(valid)/2]},
+		{"bad checksum", append(bytes.Clone(valid[:len(valid)-8]), 0, 0, 0, 0, 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(tt.body)
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := GetPR(ctx, client, "o/r", 1)
+			if err == nil {
+				t.Fatal("err = nil, want a decompression error")
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("err = %v, want an error before the deadline", err)
+			}
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"Not Found","documentation_url":"https://docs.github.com/rest"}`)
+	})
+
+	_, err := GetPR(context.Background(), client, "o/r", 1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+	for _, want := range []string{"404", "Not Found", "token cannot access", "https://docs.github.com/rest"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %q, missing %q", err, want)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1 (404 is not retried)", n)
+	}
+}
+
+func TestFilesInPRIncomplete(t *testing.T) {
+	var serverURL string
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next"`, serverURL, r.URL.Path))
+		fmt.Fprint(w, `[{"filename":"a.go","status":"modified"}]`)
+	})
+	serverURL = client.apiURL
+
+	changes, err := FilesInPR(context.Background(), client, "o/r", 1)
+	var incomplete *IncompleteError
+	if !errors.As(err, &incomplete) {
+		t.Fatalf("err = %v, want *IncompleteError", err)
+	}
+	if incomplete.Pages != 1 || len(changes) != 1 || changes[0].Filename != "a.go" {
+		t.Errorf("Pages = %d, changes = %+v", incomplete.Pages, changes)
+	}
+}
+
+func TestSetRequestTimeout(t *testing.T) {
+	t.Run("before SetHTTPClient", func(t *testing.T) {
+		hc := &http.Client{Timeout: time.Hour}
+		client := NewClient("http://example.invalid", "token", time.Minute, 1)
+		client.SetRequestTimeout(5 * time.Second)
+		client.SetHTTPClient(hc)
+		if client.httpClient.Timeout != 5*time.Second {
+			t.Errorf("Timeout = %v, want 5s", client.httpClient.Timeout)
+		}
+		if hc.Timeout != time.Hour {
+			t.Errorf("caller's Timeout changed to %v", hc.Timeout)
+		}
+	})
+	t.Run("after SetHTTPClient", func(t *testing.T) {
+		hc := &http.Client{Timeout: time.Hour}
+		client := NewClient("http://example.invalid", "token", time.Minute, 1)
+		client.SetHTTPClient(hc)
+		client.SetRequestTimeout(5 * time.Second)
+		if client.httpClient.Timeout != 5*time.Second {
+			t.Errorf("Timeout = %v, want 5s", client.httpClient.Timeout)
+		}
+		if hc.Timeout != time.Hour {
+			t.Errorf("caller's Timeout changed to %v", hc.Timeout)
+		}
+	})
+	t.Run("default", func(t *testing.T) {
+		client := NewClient("http://example.invalid", "token", time.Minute, 1)
+		client.SetHTTPClient(&http.Client{})
+		if client.httpClient.Timeout != DefaultRequestTimeout {
+			t.Errorf("Timeout = %v, want %v", client.httpClient.Timeout, DefaultRequestTimeout)
+		}
+	})
+}
+
+func TestNextPageURL(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"next and last", `<https://api.github.com/x?page=2>; rel="next", <https://api.github.com/x?page=5>; rel="last"`, "https://api.github.com/x?page=2"},
+		{"next not first", `<https://api.github.com/x?page=1>; rel="prev", <https://api.github.com/x?page=3>; rel="next"`, "https://api.github.com/x?page=3"},
+		{"last page", `<https://api.github.com/x?page=1>; rel="first", <https://api.github.com/x?page=4>; rel="prev"`, ""},
+		{"space before params", `<https://api.github.com/x?page=2> ; rel="next"`, "https://api.github.com/x?page=2"},
+		{"no header", ``, ""},
+		{"truncated target", `<https://api.github.com/x?page=2; rel="next"`, ""},
+		{"missing params", `<https://api.github.com/x?page=2>`, ""},
+		{"unquoted rel", `<https://api.github.com/x?page=2>; rel=next`, ""},
+		{"garbage", `not a link header`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.link != "" {
+				header.Set("Link", tt.link)
+			}
+			if got := nextPageURL(header); got != tt.want {
+				t.Errorf("nextPageURL(%q) = %q, want %q", tt.link, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilesInPRLinkHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		link      string
+		wantFiles int
+	}{
+		{"last page without next", `<{url}?page=1>; rel="first", <{url}?page=1>; rel="prev"`, 1},
+		{"truncated Link header", `<{url}?page=2; rel="ne`, 1},
+		{"malformed Link header", `{url}?page=2; rel="next"`, 1},
+		{"next page", `<{url}?page=2>; rel="next"`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serverURL string
+			client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("page") == "2" {
+					fmt.Fprint(w, `[{"filename":"b.go","status":"added"}]`)
+					return
+				}
+				w.Header().Set("Link", strings.ReplaceAll(tt.link, "{url}", serverURL+r.URL.Path))
+				fmt.Fprint(w, `[{"filename":"a.go","status":"modified"}]`)
+			})
+			serverURL = client.apiURL
+
+			changes, err := FilesInPR(context.Background(), client, "o/r", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != tt.wantFiles {
+				t.Errorf("got %d files, want %d", len(changes), tt.wantFiles)
+			}
+			if n := requests.Load(); int(n) != tt.wantFiles {
+				t.Errorf("requests = %d, want %d", n, tt.wantFiles)
+			}
+		})
+	}
+}
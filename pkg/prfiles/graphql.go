@@ -0,0 +1,208 @@
+package prfiles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"git.dmoruzzi.com/github-pr-files/pkg/logger"
+)
+
+const prFilesQuery = `query($owner: String!, $name: String!, $number: Int!, $cursor: String) {
+  repository(owner: $owner, name: $name) {
+    pullRequest(number: $number) {
+      files(first: 100, after: $cursor) {
+        pageInfo { hasNextPage endCursor }
+        nodes { path additions deletions changeType }
+      }
+    }
+  }
+}`
+
+const mergeQueueEntryQuery = `query($owner: String!, $name: String!, $number: Int!) {
+  repository(owner: $owner, name: $name) {
+    pullRequest(number: $number) {
+      mergeQueueEntry {
+        state
+        position
+        baseCommit { oid }
+        headCommit { oid }
+      }
+    }
+  }
+}`
+
+// graphQLStatuses maps GraphQL PatchStatus values onto the REST file
+// statuses understood by Category.
+var graphQLStatuses = map[string]string{
+	"ADDED":    "added",
+	"DELETED":  "removed",
+	"MODIFIED": "modified",
+	"RENAMED":  "renamed",
+	"COPIED":   "copied",
+	"CHANGED":  "changed",
+}
+
+// graphQLURL returns the GraphQL endpoint for the client's REST API URL.
+// GitHub Enterprise Server serves REST under /api/v3 and GraphQL under
+// /api/graphql.
+func (c *Client) graphQLURL() string {
+	return strings.TrimSuffix(c.apiURL, "/v3") + "/graphql"
+}
+
+// graphQLQuery runs query with variables and decodes the data field of the
+// response into data.
+func graphQLQuery(ctx context.Context, client *Client, query string, variables map[string]any, data any) error {
+	payload, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		return fmt.Errorf("failed to marshal query: %w", err)
+	}
+	bodyText, _, err := doGitHubRequestBody(ctx, client, "POST", client.graphQLURL(), payload)
+	if err != nil {
+		return err
+	}
+
+	// GraphQL reports errors with a 200 status, in the errors field.
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(bodyText, &response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if len(response.Errors) > 0 {
+		messages := make([]string, len(response.Errors))
+		for i, e := range response.Errors {
+			messages[i] = e.Message
+		}
+		return fmt.Errorf("GraphQL query failed: %s", strings.Join(messages, "; "))
+	}
+	if len(response.Data) == 0 {
+		return fmt.Errorf("GraphQL response has no data")
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+// FilesInPRGraphQL is FilesInPR using the GraphQL API, which is rate limited
+// separately from the REST API. GraphQL does not return patches or the
+// previous path of renamed files, so Patch and PreviousFilename are always
+// empty.
+func FilesInPRGraphQL(ctx context.Context, client *Client, repo string, pr int) ([]FileChange, error) {
+	owner, name, found := strings.Cut(repo, "/")
+	if !found {
+		return nil, fmt.Errorf("invalid repository %q: expected the format 'owner/name'", repo)
+	}
+
+	var changes []FileChange
+	var cursor *string
+	for {
+		var data struct {
+			Repository *struct {
+				PullRequest *struct {
+					Files struct {
+						PageInfo struct {
+							HasNextPage bool   `json:"hasNextPage"`
+							EndCursor   string `json:"endCursor"`
+						} `json:"pageInfo"`
+						Nodes []struct {
+							Path       string `json:"path"`
+							Additions  int    `json:"additions"`
+							Deletions  int    `json:"deletions"`
+							ChangeType string `json:"changeType"`
+						} `json:"nodes"`
+					} `json:"files"`
+				} `json:"pullRequest"`
+			} `json:"repository"`
+		}
+		variables := map[string]any{"owner": owner, "name": name, "number": pr, "cursor": cursor}
+		if err := graphQLQuery(ctx, client, prFilesQuery, variables, &data); err != nil {
+			return nil, err
+		}
+		if data.Repository == nil || data.Repository.PullRequest == nil {
+			return nil, fmt.Errorf("pull request %d not found in %s", pr, repo)
+		}
+
+		files := data.Repository.PullRequest.Files
+		for _, node := range files.Nodes {
+			status, ok := graphQLStatuses[node.ChangeType]
+			if !ok {
+				status = strings.ToLower(node.ChangeType)
+			}
+			logger.ForPR(pr).Debugf("File in PR %d: %s (Status: %s)", pr, node.Path, status)
+			changes = append(changes, FileChange{
+				Filename:  node.Path,
+				Status:    status,
+				Additions: node.Additions,
+				Deletions: node.Deletions,
+				Changes:   node.Additions + node.Deletions,
+			})
+		}
+		if !files.PageInfo.HasNextPage {
+			return changes, nil
+		}
+		cursor = &files.PageInfo.EndCursor
+	}
+}
+
+// QueueEntry is a pull request's entry in a merge queue. The queue tests
+// HeadSHA, a commit on a temporary gh-readonly-queue/... branch that merges
+// the pull request onto BaseSHA, which already includes the entries ahead of
+// it in the queue.
+type QueueEntry struct {
+	State    string // AWAITING_CHECKS, MERGEABLE, QUEUED, LOCKED, or UNMERGEABLE
+	Position int
+	BaseSHA  string
+	HeadSHA  string
+}
+
+// MergeQueueEntry returns the merge queue entry of pull request pr, or nil if
+// the pull request is not in a merge queue. The head commit is only known
+// once the queue has created the entry's merge group, so entries without one
+// are also reported as nil. Merge queues are only available through the
+// GraphQL API.
+func MergeQueueEntry(ctx context.Context, client *Client, repo string, pr int) (*QueueEntry, error) {
+	owner, name, found := strings.Cut(repo, "/")
+	if !found {
+		return nil, fmt.Errorf("invalid repository %q: expected the format 'owner/name'", repo)
+	}
+
+	type commit struct {
+		OID string `json:"oid"`
+	}
+	var data struct {
+		Repository *struct {
+			PullRequest *struct {
+				MergeQueueEntry *struct {
+					State      string  `json:"state"`
+					Position   int     `json:"position"`
+					BaseCommit *commit `json:"baseCommit"`
+					HeadCommit *commit `json:"headCommit"`
+				} `json:"mergeQueueEntry"`
+			} `json:"pullRequest"`
+		} `json:"repository"`
+	}
+	variables := map[string]any{"owner": owner, "name": name, "number": pr}
+	if err := graphQLQuery(ctx, client, mergeQueueEntryQuery, variables, &data); err != nil {
+		return nil, err
+	}
+	if data.Repository == nil || data.Repository.PullRequest == nil {
+		return nil, fmt.Errorf("pull request %d not found in %s", pr, repo)
+	}
+
+	entry := data.Repository.PullRequest.MergeQueueEntry
+	if entry == nil || entry.BaseCommit == nil || entry.HeadCommit == nil {
+		return nil, nil
+	}
+	return &QueueEntry{
+		State:    entry.State,
+		Position: entry.Position,
+		BaseSHA:  entry.BaseCommit.OID,
+		HeadSHA:  entry.HeadCommit.OID,
+	}, nil
+}
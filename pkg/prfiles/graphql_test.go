@@ -0,0 +1,91 @@
+package prfiles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// graphQLRequest decodes the query variables sent to the stub server.
+func graphQLRequest(t *testing.T, r *http.Request) map[string]any {
+	t.Helper()
+	if r.Method != http.MethodPost || r.URL.Path != "/graphql" {
+		t.Errorf("request = %s %s, want POST /graphql", r.Method, r.URL.Path)
+	}
+	var request struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		t.Errorf("failed to decode request: %v", err)
+	}
+	return request.Variables
+}
+
+func TestFilesInPRGraphQLPagination(t *testing.T) {
+	client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		variables := graphQLRequest(t, r)
+		if variables["owner"] != "o" || variables["name"] != "r" || variables["number"] != float64(7) {
+			t.Errorf("variables = %v", variables)
+		}
+		switch variables["cursor"] {
+		case nil:
+			fmt.Fprint(w, `{"data":{"repository":{"pullRequest":{"files":{
+				"pageInfo":{"hasNextPage":true,"endCursor":"c1"},
+				"nodes":[{"path":"a.go","additions":2,"deletions":1,"changeType":"MODIFIED"},{"path":"b.go","additions":4,"deletions":0,"changeType":"ADDED"}]}}}}}`)
+		case "c1":
+			fmt.Fprint(w, `{"data":{"repository":{"pullRequest":{"files":{
+				"pageInfo":{"hasNextPage":false,"endCursor":"c2"},
+				"nodes":[{"path":"c.go","additions":0,"deletions":3,"changeType":"DELETED"}]}}}}}`)
+		default:
+			t.Errorf("cursor = %v", variables["cursor"])
+		}
+	})
+
+	changes, err := FilesInPRGraphQL(context.Background(), client, "o/r", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s:%s:%d", change.Filename, change.Status, change.Changes))
+	}
+	if want := "a.go:modified:3,b.go:added:4,c.go:removed:3"; strings.Join(got, ",") != want {
+		t.Errorf("files = %s, want %s", strings.Join(got, ","), want)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+}
+
+func TestFilesInPRGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"errors in 200", `{"data":null,"errors":[{"message":"Something went wrong"},{"message":"Try again"}]}`, "GraphQL query failed: Something went wrong; Try again"},
+		{"null pull request", `{"data":{"repository":{"pullRequest":null}}}`, "pull request 7 not found in o/r"},
+		{"null repository", `{"data":{"repository":null}}`, "pull request 7 not found in o/r"},
+		{"no data", `{}`, "GraphQL response has no data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, requests := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				graphQLRequest(t, r)
+				fmt.Fprint(w, tt.body)
+			})
+
+			_, err := FilesInPRGraphQL(context.Background(), client, "o/r", 7)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if n := requests.Load(); n != 1 {
+				t.Errorf("requests = %d, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package prfiles
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"git.dmoruzzi.com/github-pr-files/pkg/logger"
+)
+
+// MaxListedFiles is the most files the pull request files endpoint returns.
+// GitHub silently cuts off the list of larger pull requests.
+const MaxListedFiles = 3000
+
+const (
+	CategoryChanged = "changed"
+	CategoryDeleted = "deleted"
+	CategoryRenamed = "renamed"
+)
+
+// FileChange is a single file entry from the pull request files API.
+type FileChange struct {
+	Filename         string `json:"filename"`
+	Status           string `json:"status"`
+	PreviousFilename string `json:"previous_filename,omitempty"`
+	Additions        int    `json:"additions"`
+	Deletions        int    `json:"deletions"`
+	Changes          int    `json:"changes"`
+	Patch            string `json:"patch,omitempty"`
+	RawURL           string `json:"raw_url,omitempty"`
+	BlobURL          string `json:"blob_url,omitempty"`
+	ContentsURL      string `json:"contents_url,omitempty"`
+
+	// Binary is not part of the API response. It is set by callers that
+	// classify files with LooksBinary.
+	Binary bool `json:"binary,omitempty"`
+	// LastAuthor is not part of the API response either. It is set by
+	// callers that look it up with LastCommitAuthor.
+	LastAuthor string `json:"last_author,omitempty"`
+}
+
+// Category maps the GitHub file status onto the changed, deleted, and renamed
+// buckets. Copies are treated as additions, with the source kept in
+// PreviousFilename. It returns an empty string for "unchanged" and for
+// statuses it does not know.
+func (f FileChange) Category() string {
+	switch f.Status {
+	case "modified", "added", "copied", "changed":
+		return CategoryChanged
+	case "removed", "deleted":
+		return CategoryDeleted
+	case "renamed":
+		return CategoryRenamed
+	}
+	return ""
+}
+
+// LooksBinary guesses whether f is a binary file: GitHub sends no patch and
+// no line counts for binary changes. The guess is wrong for empty text
+// files, which look the same, and pure renames are never reported as binary
+// because they carry no patch either way.
+func (f FileChange) LooksBinary() bool {
+	return f.Patch == "" && f.Additions == 0 && f.Deletions == 0 && f.Status != "renamed"
+}
+
+// PullRequest is the subset of pull request metadata used by this package.
+type PullRequest struct {
+	Number       int       `json:"number"`
+	ChangedFiles int       `json:"changed_files"`
+	Draft        bool      `json:"draft"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Base         Ref       `json:"base"`
+	Head         Ref       `json:"head"`
+	Labels       []Label   `json:"labels"`
+}
+
+// Label is a label applied to a pull request.
+type Label struct {
+	Name string `json:"name"`
+}
+
+// Ref identifies a pull request branch and the commit it points at.
+type Ref struct {
+	Ref string `json:"ref"`
+	SHA string `json:"sha"`
+}
+
+// IncompleteError is returned alongside a partial result when a later page of
+// a paginated listing fails after earlier pages were fetched.
+type IncompleteError struct {
+	Pages int // pages fetched successfully
+	Err   error
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("incomplete result after %d page(s): %v", e.Pages, e.Err)
+}
+
+func (e *IncompleteError) Unwrap() error {
+	return e.Err
+}
+
+// FilesInPR returns every file changed by pull request pr in repo, in the
+// order the API lists them. Entries keep GitHub's raw status; use Category to
+// map it onto the changed, deleted, and renamed buckets. Each page is retried
+// by the client; if a page still fails after earlier pages succeeded, the
+// files fetched so far are returned with an *IncompleteError. At most
+// MaxListedFiles files are returned, however large the pull request is.
+func FilesInPR(ctx context.Context, client *Client, repo string, pr int) ([]FileChange, error) {
+	var changes []FileChange
+	url := fmt.Sprintf("%s/repos/%s/pulls/%d/files?per_page=%d", client.apiURL, repo, pr, client.perPage)
+
+	for pages := 0; url != ""; pages++ {
+		bodyText, header, err := doGitHubRequest(ctx, client, url)
+		if err != nil {
+			if pages > 0 {
+				return changes, &IncompleteError{Pages: pages, Err: err}
+			}
+			return nil, err
+		}
+
+		var files []FileChange
+		if err := json.Unmarshal(bodyText, &files); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+
+		if len(files) == 0 {
+			break
+		}
+
+		for _, file := range files {
+			logger.ForPR(pr).Debugf("File in PR %d: %s (Status: %s)", pr, file.Filename, file.Status)
+		}
+		changes = append(changes, files...)
+		url = nextPageURL(header)
+	}
+
+	return changes, nil
+}
+
+// FilesInCompare returns every file changed between two refs, given as
+// "base...head". The compare API paginates by commit and may repeat files
+// across pages, so entries are deduplicated by filename.
+func FilesInCompare(ctx context.Context, client *Client, repo string, basehead string) ([]FileChange, error) {
+	var changes []FileChange
+	seen := make(map[string]bool)
+	url := fmt.Sprintf("%s/repos/%s/compare/%s?per_page=%d", client.apiURL, repo, basehead, client.perPage)
+
+	for url != "" {
+		bodyText, header, err := doGitHubRequest(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+
+		var comparison struct {
+			Files []FileChange `json:"files"`
+		}
+		if err := json.Unmarshal(bodyText, &comparison); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+
+		for _, file := range comparison.Files {
+			if seen[file.Filename] {
+				continue
+			}
+			seen[file.Filename] = true
+			logger.Debugf("File in %s: %s (Status: %s)", basehead, file.Filename, file.Status)
+			changes = append(changes, file)
+		}
+		url = nextPageURL(header)
+	}
+
+	return changes, nil
+}
+
+// FilesInCommit returns the files changed by a single commit, relative to
+// its parent. For merge commits GitHub diffs against the first parent only,
+// and the list may be empty; a warning is logged in that case.
+func FilesInCommit(ctx context.Context, client *Client, repo string, sha string) ([]FileChange, error) {
+	var changes []FileChange
+	seen := make(map[string]bool)
+	url := fmt.Sprintf("%s/repos/%s/commits/%s?per_page=%d", client.apiURL, repo, sha, client.perPage)
+	merge := false
+
+	for url != "" {
+		bodyText, header, err := doGitHubRequest(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+
+		var commit struct {
+			Parents []Ref        `json:"parents"`
+			Files   []FileChange `json:"files"`
+		}
+		if err := json.Unmarshal(bodyText, &commit); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		merge = merge || len(commit.Parents) > 1
+
+		for _, file := range commit.Files {
+			if seen[file.Filename] {
+				continue
+			}
+			seen[file.Filename] = true
+			logger.Debugf("File in %s: %s (Status: %s)", sha, file.Filename, file.Status)
+			changes = append(changes, file)
+		}
+		url = nextPageURL(header)
+	}
+
+	if merge && len(changes) == 0 {
+		logger.Warnf("Commit %s is a merge commit with no changes against its first parent; use -compare to diff against another parent", sha)
+	}
+	return changes, nil
+}
+
+// ListPRs returns all pull requests in repo with the given state ("open",
+// "closed", or "all"), or an empty slice if there are none. The listing does
+// not include ChangedFiles.
+func ListPRs(ctx context.Context, client *Client, repo string, state string) ([]PullRequest, error) {
+	var prs []PullRequest
+	url := fmt.Sprintf("%s/repos/%s/pulls?state=%s&per_page=%d", client.apiURL, repo, state, client.perPage)
+
+	for url != "" {
+		bodyText, header, err := doGitHubRequest(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+
+		var pulls []PullRequest
+		if err := json.Unmarshal(bodyText, &pulls); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+
+		if len(pulls) == 0 {
+			break
+		}
+
+		prs = append(prs, pulls...)
+		url = nextPageURL(header)
+	}
+	return prs, nil
+}
+
+// searchResultCap is the maximum number of results the search API returns for
+// a single query.
+const searchResultCap = 1000
+
+// SearchPRs returns the numbers of the pull requests matching query, using the
+// issue search syntax (e.g. "is:open label:ready repo:owner/name"). "is:pr" is
+// added if the query does not already restrict the type. The search API only
+// returns the first 1000 results, so a warning is logged if more matched.
+func SearchPRs(ctx context.Context, client *Client, query string) ([]int, error) {
+	if !strings.Contains(query, "is:pr") && !strings.Contains(query, "type:pr") {
+		query += " is:pr"
+	}
+
+	var prs []int
+	url := fmt.Sprintf("%s/search/issues?q=%s&per_page=%d", client.apiURL, neturl.QueryEscape(query), client.perPage)
+	for url != "" {
+		bodyText, header, err := doGitHubRequest(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			TotalCount int `json:"total_count"`
+			Items      []struct {
+				Number      int             `json:"number"`
+				PullRequest json.RawMessage `json:"pull_request"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(bodyText, &result); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		if len(prs) == 0 && result.TotalCount > searchResultCap {
+			logger.Warnf("Search %q matched %d items; only the first %d are returned", query, result.TotalCount, searchResultCap)
+		}
+		if len(result.Items) == 0 {
+			break
+		}
+
+		for _, item := range result.Items {
+			if item.PullRequest != nil {
+				prs = append(prs, item.Number)
+			}
+		}
+		url = nextPageURL(header)
+	}
+	return prs, nil
+}
+
+// GetPR returns the metadata of pull request pr in repo.
+func GetPR(ctx context.Context, client *Client, repo string, pr int) (*PullRequest, error) {
+	url := fmt.Sprintf("%s/repos/%s/pulls/%d", client.apiURL, repo, pr)
+	bodyText, _, err := doGitHubRequest(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var pull PullRequest
+	if err := json.Unmarshal(bodyText, &pull); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &pull, nil
+}
+
+// FilesChangedCount returns the number of files changed by pull request pr as
+// reported by the pull request metadata.
+func FilesChangedCount(ctx context.Context, client *Client, repo string, pr int) (int, error) {
+	pull, err := GetPR(ctx, client, repo, pr)
+	if err != nil {
+		return -1, err
+	}
+
+	if pull.ChangedFiles == 0 {
+		logger.Warnf("No changed files in pull request %d", pr)
+	}
+	return pull.ChangedFiles, nil
+}
+
+// PRCommits returns the SHAs of the commits in pull request pr, oldest
+// first. GitHub lists at most 250 commits per pull request.
+func PRCommits(ctx context.Context, client *Client, repo string, pr int) ([]string, error) {
+	var shas []string
+	url := fmt.Sprintf("%s/repos/%s/pulls/%d/commits?per_page=%d", client.apiURL, repo, pr, client.perPage)
+
+	for url != "" {
+		bodyText, header, err := doGitHubRequest(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+
+		var commits []Ref
+		if err := json.Unmarshal(bodyText, &commits); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		for _, commit := range commits {
+			shas = append(shas, commit.SHA)
+		}
+		url = nextPageURL(header)
+	}
+	return shas, nil
+}
+
+// LastCommitAuthor returns who made the most recent commit touching path on
+// the default branch of repo: the author's GitHub login if the commit is
+// linked to an account, otherwise the git author name. It returns an empty
+// string if no commit touches path there, for example for new files.
+func LastCommitAuthor(ctx context.Context, client *Client, repo string, path string) (string, error) {
+	url := fmt.Sprintf("%s/repos/%s/commits?path=%s&per_page=1", client.apiURL, repo, neturl.QueryEscape(path))
+	bodyText, _, err := doGitHubRequest(ctx, client, url)
+	if err != nil {
+		return "", err
+	}
+
+	var commits []struct {
+		Commit struct {
+			Author struct {
+				Name string `json:"name"`
+			} `json:"author"`
+		} `json:"commit"`
+		Author *struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}
+	if err := json.Unmarshal(bodyText, &commits); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if len(commits) == 0 {
+		return "", nil
+	}
+	if commits[0].Author != nil && commits[0].Author.Login != "" {
+		return commits[0].Author.Login, nil
+	}
+	return commits[0].Commit.Author.Name, nil
+}
+
+// FileContent returns the contents of path at ref (a branch, tag, or commit
+// SHA) in repo. The error matches ErrNotFound if path does not exist there.
+// The contents API only returns files up to 1 MB.
+func FileContent(ctx context.Context, client *Client, repo string, path string, ref string) ([]byte, error) {
+	url := fmt.Sprintf("%s/repos/%s/contents/%s?ref=%s", client.apiURL, repo, path, neturl.QueryEscape(ref))
+	bodyText, _, err := doGitHubRequest(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(bodyText, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if file.Encoding != "base64" {
+		return nil, fmt.Errorf("%s is too large for the contents API (encoding %q)", path, file.Encoding)
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(file.Content, "\n", ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return content, nil
+}
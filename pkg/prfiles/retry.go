@@ -0,0 +1,66 @@
+package prfiles
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy controls how requests that fail with a network error, a 5xx
+// response, or a 429 without rate limit headers are retried. Rate limits are
+// waited out separately, bounded by the client's maxWait.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below 1 are treated as 1, which disables retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the second attempt. It doubles for each
+	// attempt after that.
+	BaseDelay time.Duration
+	// MaxDelay caps the doubled delay before jitter is added. Zero means no
+	// cap.
+	MaxDelay time.Duration
+	// Jitter adds a random extra delay of up to this fraction of the delay,
+	// so concurrent requests that fail together do not retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the policy used by NewClient: three attempts,
+// one second of backoff doubling per attempt, and up to 50% jitter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Second,
+		Jitter:      0.5,
+	}
+}
+
+// Backoff returns the delay before retrying after the given failed attempt
+// (1 for the first), without jitter.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := max(p.BaseDelay, 0)
+	for i := 1; i < attempt && delay <= math.MaxInt64/2; i++ {
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxDelay > 0 {
+		delay = min(delay, p.MaxDelay)
+	}
+	return delay
+}
+
+// Delay returns Backoff(attempt) plus a random jitter. The sum saturates at
+// the largest Duration instead of overflowing for very large jitter.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff(attempt)
+	if p.Jitter > 0 && delay > 0 {
+		room := time.Duration(math.MaxInt64) - delay
+		jitter := room
+		if extra := float64(delay) * p.Jitter; extra < float64(room)/2 {
+			jitter = time.Duration(extra)
+		}
+		delay += rand.N(jitter + 1)
+	}
+	return delay
+}
@@ -0,0 +1,74 @@
+package prfiles
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"base delay", RetryPolicy{BaseDelay: time.Second}, 1, time.Second},
+		{"doubles", RetryPolicy{BaseDelay: time.Second}, 3, 4 * time.Second},
+		{"capped", RetryPolicy{BaseDelay: time.Second, MaxDelay: 3 * time.Second}, 3, 3 * time.Second},
+		{"cap above delay", RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, 2, 2 * time.Second},
+		{"base above cap", RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Second}, 1, time.Second},
+		{"zero base", RetryPolicy{}, 5, 0},
+		{"negative base", RetryPolicy{BaseDelay: -time.Second}, 2, 0},
+		{"attempt zero", RetryPolicy{BaseDelay: time.Second}, 0, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Backoff(tt.attempt); got != tt.want {
+				t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoffSaturates(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second}
+	prev := policy.Backoff(1)
+	for attempt := 2; attempt <= 200; attempt++ {
+		got := policy.Backoff(attempt)
+		if got < prev {
+			t.Fatalf("Backoff(%d) = %v, less than Backoff(%d) = %v (overflow)", attempt, got, attempt-1, prev)
+		}
+		prev = got
+	}
+	if prev <= time.Duration(math.MaxInt64/4) {
+		t.Errorf("Backoff(200) = %v, want it to saturate near the largest Duration", prev)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempt  int
+		min, max time.Duration
+	}{
+		{"no jitter", RetryPolicy{BaseDelay: time.Second}, 2, 2 * time.Second, 2 * time.Second},
+		{"default jitter", DefaultRetryPolicy(), 2, 2 * time.Second, 3 * time.Second},
+		{"full jitter", RetryPolicy{BaseDelay: time.Second, Jitter: 1}, 1, time.Second, 2 * time.Second},
+		{"jitter on zero delay", RetryPolicy{Jitter: 1}, 1, 0, 0},
+		{"huge jitter", RetryPolicy{BaseDelay: time.Second, Jitter: 1e12}, 1, time.Second, time.Duration(math.MaxInt64)},
+		{"infinite jitter", RetryPolicy{BaseDelay: time.Second, Jitter: math.Inf(1)}, 1, time.Second, time.Duration(math.MaxInt64)},
+		{"NaN jitter", RetryPolicy{BaseDelay: time.Second, Jitter: math.NaN()}, 1, time.Second, time.Second},
+		{"saturated backoff", RetryPolicy{BaseDelay: time.Second, Jitter: 0.5}, 200, time.Second, time.Duration(math.MaxInt64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 100 {
+				if got := tt.policy.Delay(tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("Delay(%d) = %v, want between %v and %v", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}